@@ -0,0 +1,337 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultChunkSize is the chunk size of blobs created with a chunk size
+// of 0.
+const DefaultChunkSize = 64 * 1024
+
+// manifestSize is the size of a stored blob manifest: the generation,
+// the size of the blob and the chunk size.
+const manifestSize = 20
+
+// ErrBlobClosed is returned when using a BlobWriter after it has been
+// closed or aborted.
+var ErrBlobClosed = errors.New("Blob writer is closed")
+
+// blobManifest describes a stored blob. Each write of a blob stores its
+// chunks under a new generation, so that a blob being written never
+// disturbs readers of the previous version.
+type blobManifest struct {
+	gen       uint64
+	size      int64
+	chunkSize int
+}
+
+// manifestKey returns the system key of the manifest of the blob.
+func manifestKey(key []byte) []byte {
+	return sysKey("blobs", key)
+}
+
+// chunkKey returns the system key of a chunk of a generation of the blob.
+func chunkKey(key []byte, gen uint64, chunk uint64) []byte {
+	return sysKey("blob", key, gen, chunk)
+}
+
+// blobGeneration is the system key holding the last generation given to
+// a blob being written.
+var blobGeneration = sysKey("blobgen")
+
+func init() {
+	registerSysValue("blob", wholeSysValue)
+}
+
+// nextGeneration returns a new generation for the blob, greater than any
+// given before and than the generation of the stored blob.
+//
+// The database lock must be held.
+func (db *Database) nextGeneration(key []byte) (uint64, error) {
+	var gen uint64
+	buf, err := db.get(blobGeneration)
+	switch {
+	case nil == err && 8 == len(buf):
+		gen = binary.BigEndian.Uint64(buf)
+	case nil == err:
+		return 0, errors.New("Invalid blob generation")
+	case ErrNotFound != err:
+		return 0, err
+	}
+	m, err := db.manifest(key)
+	if nil == err && m.gen > gen {
+		gen = m.gen
+	} else if nil != err && ErrNotFound != err {
+		return 0, err
+	}
+	gen++
+	return gen, db.set(blobGeneration, binary.BigEndian.AppendUint64(nil, gen))
+}
+
+// manifest returns the manifest of the blob.
+func (db *Database) manifest(key []byte) (blobManifest, error) {
+	buf, err := db.get(manifestKey(key))
+	if nil != err {
+		return blobManifest{}, err
+	}
+	if manifestSize != len(buf) {
+		return blobManifest{}, errors.New("Invalid blob manifest")
+	}
+	return blobManifest{
+		gen:       binary.BigEndian.Uint64(buf),
+		size:      int64(binary.BigEndian.Uint64(buf[8:])),
+		chunkSize: int(binary.BigEndian.Uint32(buf[16:])),
+	}, nil
+}
+
+// setManifest stores the manifest of the blob.
+func (db *Database) setManifest(key []byte, m blobManifest) error {
+	buf := make([]byte, manifestSize)
+	binary.BigEndian.PutUint64(buf, m.gen)
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.size))
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.chunkSize))
+	return db.set(manifestKey(key), buf)
+}
+
+// deleteChunks deletes the chunks of a generation of the blob.
+func (db *Database) deleteChunks(key []byte, gen uint64) error {
+	return db.scanRaw(nil, sysKey("blob", key, gen), 1000, func(chunk, _ []byte) error {
+		return db.delete(chunk)
+	})
+}
+
+// BlobWriter writes a blob in chunks. The blob, replacing any previous
+// blob with the same key, only becomes visible when the BlobWriter is
+// closed.
+type BlobWriter struct {
+	db       *Database
+	key      []byte
+	manifest blobManifest
+	buf      []byte
+	chunks   uint64
+	closed   bool
+}
+
+// CreateBlob returns a BlobWriter for the blob with the key, which is
+// stored in chunks of chunkSize bytes. Blobs are stored apart from the
+// database's other keys, so the key of a blob can also be used for a
+// value.
+//
+// Chunks go through the database's ValueCodecs. If a BlobWriter is
+// neither closed nor aborted, the chunks it has written are not deleted.
+func (db *Database) CreateBlob(key []byte, chunkSize int) *BlobWriter {
+	if 0 >= chunkSize {
+		chunkSize = DefaultChunkSize
+	}
+	return &BlobWriter{
+		db:       db,
+		key:      append([]byte{}, key...),
+		manifest: blobManifest{chunkSize: chunkSize},
+		buf:      make([]byte, 0, chunkSize),
+	}
+}
+
+// Write writes p to the blob.
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrBlobClosed
+	}
+	n := 0
+	for 0 < len(p) {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p, n = p[c:], n+c
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); nil != err {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// generation gives the blob its generation when it is first stored.
+// Generations start at 1.
+//
+// The database lock must be held.
+func (w *BlobWriter) generation() error {
+	if 0 != w.manifest.gen {
+		return nil
+	}
+	gen, err := w.db.nextGeneration(w.key)
+	if nil != err {
+		return err
+	}
+	w.manifest.gen = gen
+	return nil
+}
+
+// flush stores the buffered data as the next chunk.
+func (w *BlobWriter) flush() error {
+	w.db.lock.Lock()
+	defer w.db.lock.Unlock()
+	if err := w.generation(); nil != err {
+		return err
+	}
+	key := chunkKey(w.key, w.manifest.gen, w.chunks)
+	stored, err := w.db.encodeValue(key, w.buf)
+	if nil != err {
+		return err
+	}
+	if err = w.db.set(key, stored); nil != err {
+		return err
+	}
+	w.manifest.size += int64(len(w.buf))
+	w.chunks++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close stores the last chunk and the blob's manifest, and deletes the
+// chunks of any previous blob with the same key, in a single
+// transaction.
+func (w *BlobWriter) Close() error {
+	if w.closed {
+		return ErrBlobClosed
+	}
+	if 0 < len(w.buf) {
+		if err := w.flush(); nil != err {
+			return err
+		}
+	}
+	w.closed = true
+	w.db.lock.Lock()
+	defer w.db.lock.Unlock()
+	return w.db.update(func() error {
+		if err := w.generation(); nil != err {
+			return err
+		}
+		old, err := w.db.manifest(w.key)
+		switch {
+		case nil == err && old.gen != w.manifest.gen:
+			err = w.db.deleteChunks(w.key, old.gen)
+		case ErrNotFound == err:
+			err = nil
+		}
+		if nil != err {
+			return err
+		}
+		return w.db.setManifest(w.key, w.manifest)
+	})
+}
+
+// Abort discards the blob being written, leaving any previous blob with
+// the same key in place.
+func (w *BlobWriter) Abort() error {
+	if w.closed {
+		return ErrBlobClosed
+	}
+	w.closed = true
+	if 0 == w.manifest.gen {
+		// No chunks have been written.
+		return nil
+	}
+	w.db.lock.Lock()
+	defer w.db.lock.Unlock()
+	return w.db.update(func() error {
+		return w.db.deleteChunks(w.key, w.manifest.gen)
+	})
+}
+
+// BlobReader reads a blob, loading one chunk at a time.
+type BlobReader struct {
+	db       *Database
+	key      []byte
+	manifest blobManifest
+	offset   int64
+	// chunk is the data of the loaded chunk, and index its number.
+	chunk []byte
+	index uint64
+}
+
+// OpenBlob returns a BlobReader for the blob with the key. If the blob is
+// replaced or deleted while it is being read, reads of chunks that have
+// not yet been loaded return ErrNotFound.
+func (db *Database) OpenBlob(key []byte) (*BlobReader, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	m, err := db.manifest(key)
+	if nil != err {
+		return nil, err
+	}
+	return &BlobReader{db: db, key: append([]byte{}, key...), manifest: m}, nil
+}
+
+// Size returns the size of the blob.
+func (r *BlobReader) Size() int64 {
+	return r.manifest.size
+}
+
+// Read reads from the blob into p.
+func (r *BlobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.size {
+		return 0, io.EOF
+	}
+	index := uint64(r.offset / int64(r.manifest.chunkSize))
+	if nil == r.chunk || index != r.index {
+		if err := r.load(index); nil != err {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.offset%int64(r.manifest.chunkSize):])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load loads the chunk with the index.
+func (r *BlobReader) load(index uint64) error {
+	r.db.lock.Lock()
+	defer r.db.lock.Unlock()
+	key := chunkKey(r.key, r.manifest.gen, index)
+	stored, err := r.db.get(key)
+	if nil != err {
+		return err
+	}
+	if r.chunk, err = r.db.decodeValue(key, stored); nil != err {
+		return err
+	}
+	r.index = index
+	return nil
+}
+
+// Seek sets the offset of the next Read, as described by io.Seeker.
+func (r *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.manifest.size
+	case io.SeekStart:
+	default:
+		return r.offset, errors.New("Invalid whence")
+	}
+	if 0 > offset {
+		return r.offset, errors.New("Negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// DeleteBlob deletes the blob with the key and all its chunks, in a
+// single transaction.
+func (db *Database) DeleteBlob(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.update(func() error {
+		m, err := db.manifest(key)
+		if nil != err {
+			return err
+		}
+		if err = db.deleteChunks(key, m.gen); nil != err {
+			return err
+		}
+		return db.delete(manifestKey(key))
+	})
+}
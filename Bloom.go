@@ -0,0 +1,347 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"os"
+	"time"
+)
+
+// ErrNoBloomFilter is returned when using the Bloom filter of a database
+// opened without one.
+var ErrNoBloomFilter = errors.New("Database has no Bloom filter")
+
+// bloomMagic starts a Bloom filter sidecar file.
+var bloomMagic = []byte("gophiabloom2")
+
+// bloomGeneration is the system key holding the generation of the Bloom
+// filter sidecar saved when the database was last closed. A sidecar is
+// only loaded if its generation matches. The key is deleted when the
+// database is opened without a Bloom filter, since the sidecar then
+// misses the keys written.
+var bloomGeneration = sysKey("bloom")
+
+// BloomConfig configures the Bloom filter of a database. See
+// Environment.BloomFilter.
+type BloomConfig struct {
+	// FalsePositiveRate is the rate at which the filter reports that it
+	// may contain absent keys, once it holds ExpectedKeys keys. The
+	// default is 0.01.
+	FalsePositiveRate float64
+	// ExpectedKeys is the number of keys the filter is sized for. The
+	// default is 1000000.
+	ExpectedKeys int
+}
+
+// BloomStats describes the Bloom filter of a database.
+type BloomStats struct {
+	// Bits is the size of the filter in bits, and Hashes the number of
+	// bits set for each key.
+	Bits   uint64
+	Hashes int
+	// Keys is the number of keys added to the filter. Deleted keys stay
+	// in the filter until it is rebuilt.
+	Keys uint64
+	// EstimatedFalsePositiveRate is the false positive rate estimated from
+	// the proportion of bits set.
+	EstimatedFalsePositiveRate float64
+	// Negatives is the number of lookups answered by the filter without
+	// reading the database.
+	Negatives uint64
+	// FalsePositives is the number of lookups the filter passed to the
+	// database for keys that were not found.
+	FalsePositives uint64
+}
+
+// FalsePositiveRate returns the observed rate of lookups of absent keys
+// that the filter passed to the database.
+func (s BloomStats) FalsePositiveRate() float64 {
+	if 0 == s.Negatives+s.FalsePositives {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.Negatives+s.FalsePositives)
+}
+
+// bloomFilter is a Bloom filter of the keys in a database, other than
+// system keys. It is a rawLayer, only used with the database lock held.
+type bloomFilter struct {
+	config BloomConfig
+	bits   []uint64
+	hashes int
+	keys   uint64
+
+	negatives      uint64
+	falsePositives uint64
+}
+
+// newBloomFilter returns an empty Bloom filter sized for the expected
+// keys.
+func newBloomFilter(config BloomConfig) *bloomFilter {
+	n := config.ExpectedKeys
+	m := math.Ceil(-float64(n) * math.Log(config.FalsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if 1 > k {
+		k = 1
+	}
+	return &bloomFilter{config: config, bits: make([]uint64, (uint64(m)+63)/64), hashes: k}
+}
+
+// locations calls fn with the bit positions of the key, derived from two
+// hashes of the key.
+func (f *bloomFilter) locations(key []byte, fn func(i uint64) bool) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := bits.RotateLeft64(h1, 32) | 1
+	m := uint64(len(f.bits)) * 64
+	for i := 0; i < f.hashes; i++ {
+		if !fn((h1 + uint64(i)*h2) % m) {
+			return
+		}
+	}
+}
+
+// add adds the key to the filter.
+func (f *bloomFilter) add(key []byte) {
+	f.keys++
+	f.locations(key, func(i uint64) bool {
+		f.bits[i/64] |= 1 << (i % 64)
+		return true
+	})
+}
+
+// lookup answers a read of the key if it is certainly not in the filter,
+// counting the lookup as a negative.
+func (f *bloomFilter) lookup(key []byte) ([]byte, bool, bool) {
+	absent := false
+	f.locations(key, func(i uint64) bool {
+		absent = 0 == f.bits[i/64]&(1<<(i%64))
+		return !absent
+	})
+	if absent {
+		f.negatives++
+	}
+	return nil, false, absent
+}
+
+// loaded counts a lookup of a key the filter did not exclude, but the
+// database did not have.
+func (f *bloomFilter) loaded(key, value []byte) {
+	if nil == value {
+		f.falsePositives++
+	}
+}
+
+// written adds a key to the filter as it is set.
+func (f *bloomFilter) written(key, value []byte, tx bool) {
+	if nil != value {
+		f.add(key)
+	}
+}
+
+func (f *bloomFilter) endTx(committed bool) {}
+
+// stats returns the BloomStats of the filter.
+func (f *bloomFilter) stats() BloomStats {
+	set := 0
+	for _, w := range f.bits {
+		set += bits.OnesCount64(w)
+	}
+	m := uint64(len(f.bits)) * 64
+	return BloomStats{
+		Bits:                       m,
+		Hashes:                     f.hashes,
+		Keys:                       f.keys,
+		EstimatedFalsePositiveRate: math.Pow(float64(set)/float64(m), float64(f.hashes)),
+		Negatives:                  f.negatives,
+		FalsePositives:             f.falsePositives,
+	}
+}
+
+// bloomPath returns the path of the Bloom filter sidecar file of the
+// database directory, which is kept beside the directory so that Sophia
+// does not see it.
+func bloomPath(dir string) string {
+	return dir + ".bloom"
+}
+
+// save writes the filter to the sidecar file at the path, with its
+// generation.
+func (f *bloomFilter) save(path string, generation uint64) error {
+	buf := append([]byte{}, bloomMagic...)
+	buf = binary.BigEndian.AppendUint64(buf, generation)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(f.config.FalsePositiveRate))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(f.config.ExpectedKeys))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(f.hashes))
+	buf = binary.BigEndian.AppendUint64(buf, f.keys)
+	for _, w := range f.bits {
+		buf = binary.BigEndian.AppendUint64(buf, w)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); nil != err {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadBloomFilter reads the filter from the sidecar file at the path. If
+// remove is true, it removes the file, so that a filter is never loaded
+// after writes it has missed. It returns nil if there is no file, or it
+// was saved with another generation or BloomConfig.
+func loadBloomFilter(path string, config BloomConfig, generation uint64, remove bool) (*bloomFilter, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	if remove {
+		if err = os.Remove(path); nil != err {
+			return nil, err
+		}
+	}
+	header := len(bloomMagic) + 36
+	if len(buf) < header || string(bloomMagic) != string(buf[:len(bloomMagic)]) || 0 != (len(buf)-header)%8 {
+		return nil, nil
+	}
+	buf = buf[len(bloomMagic):]
+	if 0 == generation || generation != binary.BigEndian.Uint64(buf) {
+		return nil, nil
+	}
+	buf = buf[8:]
+	if config.FalsePositiveRate != math.Float64frombits(binary.BigEndian.Uint64(buf)) ||
+		uint64(config.ExpectedKeys) != binary.BigEndian.Uint64(buf[8:]) {
+		return nil, nil
+	}
+	f := &bloomFilter{
+		config: config,
+		hashes: int(binary.BigEndian.Uint32(buf[16:])),
+		keys:   binary.BigEndian.Uint64(buf[20:]),
+		bits:   make([]uint64, (len(buf)-28)/8),
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(buf[28+8*i:])
+	}
+	if 0 == len(f.bits) || 0 == f.hashes {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// BloomFilter sets the database to be opened with a Bloom filter of its
+// keys, so that Get and Has answer most lookups of absent keys without
+// calling into Sophia. The filter is kept in memory, and saved beside the
+// database directory when the database is closed. When the database is
+// opened, the saved filter is loaded, or the filter is rebuilt by
+// scanning every key if there is none, or the database has been opened
+// without the filter since it was saved.
+func (env *Environment) BloomFilter(config BloomConfig) error {
+	if 0 == config.FalsePositiveRate {
+		config.FalsePositiveRate = 0.01
+	}
+	if 0 >= config.FalsePositiveRate || 1 <= config.FalsePositiveRate {
+		return errors.New("Bloom filter false positive rate must be between 0 and 1")
+	}
+	if 0 >= config.ExpectedKeys {
+		config.ExpectedKeys = 1000000
+	}
+	env.bloom = &config
+	return nil
+}
+
+// openBloomFilter loads or builds the Bloom filter of the database.
+//
+// The database lock must be held.
+func (db *Database) openBloomFilter(config BloomConfig) error {
+	if "" != db.dir {
+		var generation uint64
+		buf, err := db.get(bloomGeneration)
+		switch {
+		case nil == err && 8 == len(buf):
+			generation = binary.BigEndian.Uint64(buf)
+		case nil != err && ErrNotFound != err:
+			return err
+		}
+		// A read only database is not written, so its sidecar stays
+		// valid, and is not saved again when it is closed.
+		f, err := loadBloomFilter(bloomPath(db.dir), config, generation, !db.readOnly)
+		if nil != err {
+			return err
+		}
+		if nil != f {
+			db.bloom = f
+			db.resetLayers()
+			return nil
+		}
+	}
+	return db.buildBloomFilter(config)
+}
+
+// saveBloomFilter saves the Bloom filter beside the database directory,
+// with a new generation.
+//
+// The database lock must be held.
+func (db *Database) saveBloomFilter() error {
+	generation := uint64(time.Now().UnixNano())
+	buf := binary.BigEndian.AppendUint64(nil, generation)
+	if err := db.set(bloomGeneration, buf); nil != err {
+		return err
+	}
+	return db.bloom.save(bloomPath(db.dir), generation)
+}
+
+// dropBloomGeneration deletes the bloomGeneration, if there is one, as
+// the database is opened without a Bloom filter.
+//
+// The database lock must be held.
+func (db *Database) dropBloomGeneration() error {
+	if _, err := db.get(bloomGeneration); nil != err {
+		if ErrNotFound == err {
+			return nil
+		}
+		return err
+	}
+	return db.delete(bloomGeneration)
+}
+
+// buildBloomFilter builds the Bloom filter by scanning every key.
+//
+// The database lock must be held.
+func (db *Database) buildBloomFilter(config BloomConfig) error {
+	f := newBloomFilter(config)
+	err := db.scanRaw(nil, nil, 1000, func(key, _ []byte) error {
+		f.add(key)
+		return nil
+	})
+	if nil != err {
+		return err
+	}
+	db.bloom = f
+	db.resetLayers()
+	return nil
+}
+
+// RebuildBloomFilter rebuilds the Bloom filter by scanning every key,
+// dropping the keys that have been deleted.
+func (db *Database) RebuildBloomFilter() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.bloom {
+		return ErrNoBloomFilter
+	}
+	return db.buildBloomFilter(db.bloom.config)
+}
+
+// BloomStats returns the statistics of the Bloom filter.
+func (db *Database) BloomStats() (BloomStats, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.bloom {
+		return BloomStats{}, ErrNoBloomFilter
+	}
+	return db.bloom.stats(), nil
+}
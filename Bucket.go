@@ -0,0 +1,237 @@
+package gophia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+)
+
+// Bucket is a namespace of keys within a Database. Keys set in a Bucket
+// are transparently prefixed, so they never clash with keys in the
+// database or in other Buckets, and a Bucket's Cursor only iterates over
+// the Bucket's own keys.
+//
+// Buckets can be nested, and their rows go through the database's
+// ValueCodecs and indexes like any other row. Buckets take part in any
+// transaction in progress on the database.
+//
+// Buckets rely on the default bytewise ordering of keys.
+type Bucket struct {
+	db   *Database
+	path []string
+	// base is the prefix of the keys of the Bucket and all its nested
+	// Buckets.
+	base []byte
+	// rows is the prefix of the keys of the Bucket's own rows.
+	rows []byte
+}
+
+// root returns the Bucket whose nested Buckets are the database's
+// top-level Buckets.
+func (db *Database) root() *Bucket {
+	return &Bucket{db: db, base: bucketPrefix}
+}
+
+// Bucket returns the named top-level Bucket, creating it if it does not
+// exist.
+func (db *Database) Bucket(name string) (*Bucket, error) {
+	return db.root().Bucket(name)
+}
+
+// Buckets returns the names of the database's top-level Buckets.
+func (db *Database) Buckets() ([]string, error) {
+	return db.root().Buckets()
+}
+
+// DeleteBucket deletes the named top-level Bucket, along with all its
+// rows and nested Buckets.
+func (db *Database) DeleteBucket(name string) error {
+	return db.root().DeleteBucket(name)
+}
+
+// child returns the Bucket nested in b with the name, without creating
+// it.
+func (b *Bucket) child(name string) *Bucket {
+	c := &Bucket{db: b.db, path: append(append([]string{}, b.path...), name)}
+	c.base, _ = appendKeyPart(append([]byte{}, b.base...), name)
+	c.rows = append(append([]byte{}, c.base...), 0)
+	return c
+}
+
+// registryKey returns the system key holding the names of the Buckets
+// nested in b.
+func (b *Bucket) registryKey() []byte {
+	parts := []interface{}{"buckets"}
+	for _, p := range b.path {
+		parts = append(parts, p)
+	}
+	return sysKey(parts...)
+}
+
+// Path returns the names of the Bucket and the Buckets it is nested in,
+// outermost first.
+func (b *Bucket) Path() []string {
+	return append([]string{}, b.path...)
+}
+
+// Bucket returns the named Bucket nested in b, creating it if it does
+// not exist.
+func (b *Bucket) Bucket(name string) (*Bucket, error) {
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+	err := b.db.update(func() error {
+		names, err := b.buckets()
+		if nil != err {
+			return err
+		}
+		i := sort.SearchStrings(names, name)
+		if i < len(names) && name == names[i] {
+			return nil
+		}
+		names = append(names[:i], append([]string{name}, names[i:]...)...)
+		return b.setRegistry(names)
+	})
+	if nil != err {
+		return nil, err
+	}
+	return b.child(name), nil
+}
+
+// Buckets returns the names of the Buckets nested in b, in order.
+func (b *Bucket) Buckets() ([]string, error) {
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+	return b.buckets()
+}
+
+func (b *Bucket) buckets() ([]string, error) {
+	buf, err := b.db.get(b.registryKey())
+	if ErrNotFound == err {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	var names []string
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&names)
+	return names, err
+}
+
+// setRegistry stores the names of the Buckets nested in b.
+func (b *Bucket) setRegistry(names []string) error {
+	if 0 == len(names) {
+		return b.db.delete(b.registryKey())
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(names); nil != err {
+		return err
+	}
+	return b.db.set(b.registryKey(), buf.Bytes())
+}
+
+// DeleteBucket deletes the named Bucket nested in b, along with all its
+// rows and nested Buckets.
+func (b *Bucket) DeleteBucket(name string) error {
+	c := b.child(name)
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+	return b.db.update(func() error {
+		names, err := b.buckets()
+		if nil != err {
+			return err
+		}
+		i := sort.SearchStrings(names, name)
+		if i == len(names) || name != names[i] {
+			return ErrNotFound
+		}
+		err = b.db.scanRaw(nil, c.base, 1000, func(key, _ []byte) error {
+			return b.db.remove(key)
+		})
+		if nil != err {
+			return err
+		}
+		err = b.db.scanRaw(nil, c.registryKey(), 1000, func(key, _ []byte) error {
+			return b.db.delete(key)
+		})
+		if nil != err {
+			return err
+		}
+		return b.setRegistry(append(names[:i], names[i+1:]...))
+	})
+}
+
+// key returns the database key for a key in the Bucket.
+func (b *Bucket) key(key []byte) []byte {
+	return append(append([]byte{}, b.rows...), key...)
+}
+
+// Cursor returns a Cursor over the rows in the Bucket. The Cursor's keys
+// do not include the Bucket's prefix. See Database.Cursor.
+//
+// The rows of a Bucket are only read together if the database orders
+// keys bytewise, or bytewise in reverse, so Cursor returns ErrKeyOrder in
+// a database with a custom key order.
+func (b *Bucket) Cursor(order Order, key []byte) (*Cursor, error) {
+	if customOrder == b.db.order {
+		return nil, ErrKeyOrder
+	}
+	start := b.key(key)
+	if nil == key {
+		// Find the bytewise direction of the order, which is reversed in
+		// a reverse ordered database.
+		ascending := GT == order || GTE == order
+		if reverseOrder == b.db.order {
+			ascending = !ascending
+		}
+		if ascending {
+			order = GTE
+		} else {
+			// Start after the last possible key in the Bucket.
+			start[len(start)-1]++
+			order = LT
+		}
+		if reverseOrder == b.db.order {
+			order = order.reverse()
+		}
+	}
+	cur, err := b.db.Cursor(order, start)
+	if nil != err {
+		return nil, err
+	}
+	cur.prefix = b.rows
+	return cur, nil
+}
+
+// Delete deletes the key from the Bucket.
+func (b *Bucket) Delete(key []byte) error {
+	return b.db.Delete(b.key(key))
+}
+
+// Each iterates through the key-values in the Bucket, passing each to the
+// each function. See Database.Each.
+func (b *Bucket) Each(order Order, key []byte, each func(key []byte, value []byte)) error {
+	cur, err := b.Cursor(order, key)
+	if nil != err {
+		return err
+	}
+	defer cur.Close()
+	for cur.Fetch() {
+		each(cur.Key(), cur.Value())
+	}
+	return nil
+}
+
+// Get retrieves the value for the key in the Bucket.
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	return b.db.Get(b.key(key))
+}
+
+// Has returns true if the Bucket has a value for the key.
+func (b *Bucket) Has(key []byte) (bool, error) {
+	return b.db.Has(b.key(key))
+}
+
+// Set sets the value of the key in the Bucket.
+func (b *Bucket) Set(key, value []byte) error {
+	return b.db.Set(b.key(key), value)
+}
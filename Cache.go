@@ -0,0 +1,172 @@
+package gophia
+
+import (
+	"container/list"
+)
+
+// CacheStats describes the read cache of a database.
+type CacheStats struct {
+	// Hits is the number of lookups answered from the cache, and Misses
+	// the number that read the database.
+	Hits   uint64
+	Misses uint64
+	// Entries is the number of cached keys, and Bytes the size of their
+	// keys and values, which is at most Capacity.
+	Entries  int
+	Bytes    int
+	Capacity int
+}
+
+// cacheEntry is a cached key and its stored value.
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+// cache is a least recently used cache of stored values, bounded by the
+// total size of its keys and values. It is only used with the database
+// lock held.
+type cache struct {
+	capacity int
+	size     int
+	entries  map[string]*list.Element
+	lru      *list.List
+	// dirty holds the keys written in the transaction in progress,
+	// which are evicted again if the transaction is rolled back.
+	dirty map[string]struct{}
+
+	hits, misses uint64
+}
+
+func newCache(capacity int) *cache {
+	return &cache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		dirty:    map[string]struct{}{},
+	}
+}
+
+// entry returns the cache entry of the key, counting the lookup as a hit
+// or a miss.
+func (c *cache) entry(key []byte) (*cacheEntry, bool) {
+	e, ok := c.entries[string(key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+
+// get returns a copy of the cached value of the key.
+func (c *cache) get(key []byte) ([]byte, bool) {
+	entry, ok := c.entry(key)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, entry.value...), true
+}
+
+// lookup answers a read of the key if it is cached.
+func (c *cache) lookup(key []byte) ([]byte, bool, bool) {
+	value, ok := c.get(key)
+	return value, ok, ok
+}
+
+// loaded caches a value read from the database.
+func (c *cache) loaded(key, value []byte) {
+	if nil != value {
+		c.put(key, value)
+	}
+}
+
+// put caches a copy of the value of the key, evicting the least recently
+// used keys to make room.
+func (c *cache) put(key, value []byte) {
+	size := len(key) + len(value)
+	if size > c.capacity {
+		return
+	}
+	c.evict(key)
+	c.entries[string(key)] = c.lru.PushFront(&cacheEntry{string(key), append([]byte{}, value...)})
+	c.size += size
+	for c.size > c.capacity {
+		c.evict([]byte(c.lru.Back().Value.(*cacheEntry).key))
+	}
+}
+
+// evict removes the key from the cache.
+func (c *cache) evict(key []byte) {
+	e, ok := c.entries[string(key)]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*cacheEntry)
+	c.size -= len(entry.key) + len(entry.value)
+	delete(c.entries, entry.key)
+	c.lru.Remove(e)
+}
+
+// written evicts the key as it is written, remembering it if a
+// transaction is in progress.
+func (c *cache) written(key, _ []byte, tx bool) {
+	c.evict(key)
+	if tx {
+		c.dirty[string(key)] = struct{}{}
+	}
+}
+
+// endTx ends the transaction in progress, evicting the keys it wrote if
+// it did not commit, since they may have been cached with values that
+// were discarded.
+func (c *cache) endTx(committed bool) {
+	if !committed {
+		for key := range c.dirty {
+			c.evict([]byte(key))
+		}
+	}
+	c.dirty = map[string]struct{}{}
+}
+
+// SetCacheSize sets the capacity in bytes of a least recently used cache
+// of the values read by Get and Has, replacing any cached values. The
+// size of a cached key is the length of its key and stored value. A
+// capacity of 0 disables the cache. The cache cannot be changed while a
+// transaction is in progress.
+//
+// Writes evict keys from the cache, so the cache never serves a value
+// that has been overwritten or deleted, or that was written by a
+// transaction that was rolled back. Keys that gophia uses internally are
+// not cached.
+func (db *Database) SetCacheSize(capacity int) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.tx {
+		return ErrTransactionInProgress
+	}
+	db.cache = nil
+	if 0 < capacity {
+		db.cache = newCache(capacity)
+	}
+	db.resetLayers()
+	return nil
+}
+
+// CacheStats returns the statistics of the read cache, which are zero if
+// there is no cache.
+func (db *Database) CacheStats() CacheStats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.cache {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:     db.cache.hits,
+		Misses:   db.cache.misses,
+		Entries:  len(db.cache.entries),
+		Bytes:    db.cache.size,
+		Capacity: db.cache.capacity,
+	}
+}
@@ -0,0 +1,60 @@
+package gophia
+
+// ValueCodec transforms values as they are written to and read from
+// the database. The key is provided so that a codec can bind a value
+// to its key, but codecs must not change the key.
+type ValueCodec interface {
+	// Encode transforms a value before it is stored.
+	Encode(key, value []byte) ([]byte, error)
+	// Decode reverses Encode on a stored value.
+	Decode(key, value []byte) ([]byte, error)
+}
+
+// AddCodec adds a ValueCodec to the database. Values are encoded by
+// each codec in the order they were added, and decoded in the reverse
+// order.
+//
+// Codecs apply to Set, Get and Cursor.Value, and so to all the
+// convenience methods that use them. They should be added before the
+// database is used, and must be added in the same order each time the
+// database is opened.
+func (db *Database) AddCodec(codec ValueCodec) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.codecs = append(db.codecs, codec)
+}
+
+// encodeValue applies the database's codecs to a value being stored.
+func (db *Database) encodeValue(key, value []byte) ([]byte, error) {
+	var err error
+	for _, c := range db.codecs {
+		value, err = c.Encode(key, value)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// decodeValue reverses the database's codecs on a stored value.
+func (db *Database) decodeValue(key, value []byte) ([]byte, error) {
+	var err error
+	for i := len(db.codecs) - 1; i >= 0; i-- {
+		value, err = db.codecs[i].Decode(key, value)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// decodeStored splits a stored value into its expiry time and its value
+// as encoded by the ValueCodecs, and decodes the value.
+func (db *Database) decodeStored(key, stored []byte) ([]byte, int64, error) {
+	expires, value := db.splitExpiry(stored)
+	if 0 == len(db.codecs) {
+		return value, expires, nil
+	}
+	value, err := db.decodeValue(key, value)
+	return value, expires, err
+}
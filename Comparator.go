@@ -0,0 +1,73 @@
+package gophia
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+)
+
+// KeyComparator orders keys in the database.
+//
+// Compare must return 0 if the keys are equal, -1 if a is lower,
+// and 1 if b is lower. The slices point directly into Sophia's memory,
+// and are only valid for the duration of the call: they must not be
+// modified or retained.
+//
+// See Environment.CmpKeys()
+type KeyComparator interface {
+	Compare(a, b []byte) int
+}
+
+// Compare calls the Comparator function, so that any Comparator
+// is also a KeyComparator.
+func (c Comparator) Compare(a, b []byte) int {
+	return c(a, b)
+}
+
+// NativeComparator is one of the built-in key orderings. When set on an
+// Environment, a NativeComparator runs entirely in C, so it is much
+// faster than a Go comparator.
+type NativeComparator int
+
+const (
+	// BytesComparator orders keys bytewise, which is Sophia's default.
+	BytesComparator NativeComparator = iota
+	// ReverseBytesComparator orders keys bytewise, largest first.
+	ReverseBytesComparator
+	// Uint32Comparator orders 4 byte keys as native-endian uint32 values.
+	Uint32Comparator
+	// Uint64Comparator orders 8 byte keys as native-endian uint64 values.
+	Uint64Comparator
+	// Int64Comparator orders 8 byte keys as native-endian int64 values.
+	Int64Comparator
+)
+
+// Compare orders the keys in Go exactly as the C implementation
+// would. Keys of the wrong length for a numeric ordering are ordered by
+// length, and then bytewise, so that the ordering stays total.
+func (n NativeComparator) Compare(a, b []byte) int {
+	size := 8
+	switch n {
+	case BytesComparator:
+		return bytes.Compare(a, b)
+	case ReverseBytesComparator:
+		return bytes.Compare(b, a)
+	case Uint32Comparator:
+		size = 4
+	}
+	if size != len(a) || size != len(b) {
+		if len(a) != len(b) {
+			return cmp.Compare(len(a), len(b))
+		}
+		return bytes.Compare(a, b)
+	}
+	switch n {
+	case Uint32Comparator:
+		return cmp.Compare(binary.NativeEndian.Uint32(a), binary.NativeEndian.Uint32(b))
+	case Uint64Comparator:
+		return cmp.Compare(binary.NativeEndian.Uint64(a), binary.NativeEndian.Uint64(b))
+	case Int64Comparator:
+		return cmp.Compare(int64(binary.NativeEndian.Uint64(a)), int64(binary.NativeEndian.Uint64(b)))
+	}
+	return bytes.Compare(a, b)
+}
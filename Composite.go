@@ -0,0 +1,548 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrIndexOutOfRange is returned when accessing a List element that does
+// not exist.
+var ErrIndexOutOfRange = errors.New("List index out of range")
+
+// elementFormat is the first byte of a stored Hash value or List element,
+// so that empty values are not stored as empty values.
+const elementFormat byte = 1
+
+// setElement stores the value under the key, through the ValueCodecs.
+//
+// The database lock must be held.
+func (db *Database) setElement(key, value []byte) error {
+	stored, err := db.encodeValue(key, value)
+	if nil != err {
+		return err
+	}
+	return db.set(key, append([]byte{elementFormat}, stored...))
+}
+
+// getElement returns the value stored under the key by setElement.
+//
+// The database lock must be held.
+func (db *Database) getElement(key []byte) ([]byte, error) {
+	stored, err := db.get(key)
+	if nil != err {
+		return nil, err
+	}
+	return db.decodeElement(key, stored)
+}
+
+// decodeElement decodes the stored value of an element.
+func (db *Database) decodeElement(key, stored []byte) ([]byte, error) {
+	if 0 == len(stored) || elementFormat != stored[0] {
+		return nil, errors.New("Invalid stored element")
+	}
+	return db.decodeValue(key, stored[1:])
+}
+
+func init() {
+	element := func(entry []byte, _ []interface{}, _ []byte) (sysValue, bool) {
+		return sysValue{key: entry, header: 1}, true
+	}
+	registerSysValue("hash", element)
+	registerSysValue("list", element)
+}
+
+// length returns the length stored under the key, or 0 if there is none.
+//
+// The database lock must be held.
+func (db *Database) length(key []byte) (int, error) {
+	buf, err := db.get(key)
+	if ErrNotFound == err {
+		return 0, nil
+	}
+	if nil != err {
+		return 0, err
+	}
+	if 8 != len(buf) {
+		return 0, errors.New("Invalid stored length")
+	}
+	return int(binary.BigEndian.Uint64(buf)), nil
+}
+
+// hasRaw returns true if the database holds the key, as it is stored,
+// without applying deferred merges, expiry times or the ValueCodecs.
+//
+// The database lock must be held.
+func (db *Database) hasRaw(key []byte) (bool, error) {
+	_, err := db.get(key)
+	if ErrNotFound == err {
+		return false, nil
+	}
+	return nil == err, err
+}
+
+// addLength adds delta to the length stored under the key, deleting the
+// key when the length reaches 0.
+//
+// The database lock must be held.
+func (db *Database) addLength(key []byte, delta int) error {
+	n, err := db.length(key)
+	if nil != err || 0 == delta {
+		return err
+	}
+	if 0 == n+delta {
+		return db.delete(key)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(n+delta))
+	return db.set(key, buf)
+}
+
+// Hash is a map of fields to values, like a Redis hash. Each field is
+// stored under its own key, so fields are read and written individually.
+type Hash struct {
+	db   *Database
+	name string
+}
+
+// Hash returns the named Hash.
+func (db *Database) Hash(name string) *Hash {
+	return &Hash{db: db, name: name}
+}
+
+func (h *Hash) fieldKey(field []byte) []byte {
+	return sysKey("hash", h.name, field)
+}
+
+func (h *Hash) lenKey() []byte {
+	return sysKey("len", "hash", h.name)
+}
+
+// Set sets the value of the field.
+func (h *Hash) Set(field, value []byte) error {
+	return h.SetMany(map[string][]byte{string(field): value})
+}
+
+// SetMany sets the values of the fields in a single transaction.
+func (h *Hash) SetMany(fields map[string][]byte) error {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	return h.db.update(func() error {
+		added := 0
+		for field, value := range fields {
+			key := h.fieldKey([]byte(field))
+			exists, err := h.db.hasRaw(key)
+			if nil != err {
+				return err
+			}
+			if !exists {
+				added++
+			}
+			if err = h.db.setElement(key, value); nil != err {
+				return err
+			}
+		}
+		return h.db.addLength(h.lenKey(), added)
+	})
+}
+
+// Get returns the value of the field.
+func (h *Hash) Get(field []byte) ([]byte, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	return h.db.getElement(h.fieldKey(field))
+}
+
+// Has returns true if the Hash has the field.
+func (h *Hash) Has(field []byte) (bool, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	return h.db.hasRaw(h.fieldKey(field))
+}
+
+// Delete deletes the fields in a single transaction, and returns the
+// number of fields that existed.
+func (h *Hash) Delete(fields ...[]byte) (int, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	removed := 0
+	err := h.db.update(func() error {
+		for _, field := range fields {
+			key := h.fieldKey(field)
+			exists, err := h.db.hasRaw(key)
+			if nil != err {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if err = h.db.delete(key); nil != err {
+				return err
+			}
+			removed++
+		}
+		return h.db.addLength(h.lenKey(), -removed)
+	})
+	if nil != err {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Len returns the number of fields in the Hash.
+func (h *Hash) Len() (int, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	return h.db.length(h.lenKey())
+}
+
+// All returns all the fields and values of the Hash.
+func (h *Hash) All() (map[string][]byte, error) {
+	h.db.lock.Lock()
+	defer h.db.lock.Unlock()
+	prefix := sysKey("hash", h.name)
+	all := map[string][]byte{}
+	err := h.db.scanRaw(nil, prefix, 1000, func(key, stored []byte) error {
+		field, _, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		value, err := h.db.decodeElement(key, stored)
+		if nil != err {
+			return err
+		}
+		all[string(field.([]byte))] = value
+		return nil
+	})
+	return all, err
+}
+
+// MemberSet is a set of members, like a Redis set. Each member is stored
+// under its own key.
+type MemberSet struct {
+	db   *Database
+	name string
+}
+
+// MemberSet returns the named MemberSet.
+func (db *Database) MemberSet(name string) *MemberSet {
+	return &MemberSet{db: db, name: name}
+}
+
+func (s *MemberSet) memberKey(member []byte) []byte {
+	return sysKey("set", s.name, member)
+}
+
+func (s *MemberSet) lenKey() []byte {
+	return sysKey("len", "set", s.name)
+}
+
+// Add adds the members to the set in a single transaction, and returns
+// the number that were not already in the set.
+func (s *MemberSet) Add(members ...[]byte) (int, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	added := 0
+	err := s.db.update(func() error {
+		for _, member := range members {
+			key := s.memberKey(member)
+			exists, err := s.db.hasRaw(key)
+			if nil != err {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err = s.db.set(key, []byte{elementFormat}); nil != err {
+				return err
+			}
+			added++
+		}
+		return s.db.addLength(s.lenKey(), added)
+	})
+	if nil != err {
+		return 0, err
+	}
+	return added, nil
+}
+
+// Remove removes the members from the set in a single transaction, and
+// returns the number that were in the set.
+func (s *MemberSet) Remove(members ...[]byte) (int, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	removed := 0
+	err := s.db.update(func() error {
+		for _, member := range members {
+			key := s.memberKey(member)
+			exists, err := s.db.hasRaw(key)
+			if nil != err {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if err = s.db.delete(key); nil != err {
+				return err
+			}
+			removed++
+		}
+		return s.db.addLength(s.lenKey(), -removed)
+	})
+	if nil != err {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Has returns true if the member is in the set.
+func (s *MemberSet) Has(member []byte) (bool, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	return s.db.hasRaw(s.memberKey(member))
+}
+
+// Len returns the number of members in the set.
+func (s *MemberSet) Len() (int, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	return s.db.length(s.lenKey())
+}
+
+// Members returns the members of the set, in bytewise order.
+func (s *MemberSet) Members() ([][]byte, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	prefix := sysKey("set", s.name)
+	var members [][]byte
+	err := s.db.scanRaw(nil, prefix, 1000, func(key, _ []byte) error {
+		member, _, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		members = append(members, member.([]byte))
+		return nil
+	})
+	return members, err
+}
+
+// List is a list of values that can be pushed and popped at both ends,
+// like a Redis list. Each element is stored under a key ordered by its
+// position, and the positions of the ends are stored with the List.
+type List struct {
+	db   *Database
+	name string
+}
+
+// List returns the named List.
+func (db *Database) List(name string) *List {
+	return &List{db: db, name: name}
+}
+
+func (l *List) elementKey(pos int64) []byte {
+	return sysKey("list", l.name, pos)
+}
+
+func (l *List) endsKey() []byte {
+	return sysKey("len", "list", l.name)
+}
+
+// ends returns the position of the first element, and the position after
+// the last element.
+//
+// The database lock must be held.
+func (l *List) ends() (int64, int64, error) {
+	buf, err := l.db.get(l.endsKey())
+	if ErrNotFound == err {
+		return 0, 0, nil
+	}
+	if nil != err {
+		return 0, 0, err
+	}
+	if 16 != len(buf) {
+		return 0, 0, errors.New("Invalid list ends")
+	}
+	return int64(binary.BigEndian.Uint64(buf)), int64(binary.BigEndian.Uint64(buf[8:])), nil
+}
+
+// setEnds stores the positions of the ends of the List.
+//
+// The database lock must be held.
+func (l *List) setEnds(head, tail int64) error {
+	if head == tail {
+		return l.db.delete(l.endsKey())
+	}
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(head))
+	binary.BigEndian.PutUint64(buf[8:], uint64(tail))
+	return l.db.set(l.endsKey(), buf)
+}
+
+// PushBack appends the values to the end of the List, in a single
+// transaction, and returns the new length.
+func (l *List) PushBack(values ...[]byte) (int, error) {
+	return l.push(false, values)
+}
+
+// PushFront prepends the values to the front of the List, in a single
+// transaction, and returns the new length. The last value becomes the
+// first element.
+func (l *List) PushFront(values ...[]byte) (int, error) {
+	return l.push(true, values)
+}
+
+func (l *List) push(front bool, values [][]byte) (int, error) {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	var head, tail int64
+	err := l.db.update(func() error {
+		var err error
+		if head, tail, err = l.ends(); nil != err {
+			return err
+		}
+		for _, value := range values {
+			pos := tail
+			if front {
+				head--
+				pos = head
+			} else {
+				tail++
+			}
+			if err = l.db.setElement(l.elementKey(pos), value); nil != err {
+				return err
+			}
+		}
+		return l.setEnds(head, tail)
+	})
+	return int(tail - head), err
+}
+
+// PopBack removes and returns the last element of the List, or returns
+// ErrNotFound if the List is empty.
+func (l *List) PopBack() ([]byte, error) {
+	return l.pop(false)
+}
+
+// PopFront removes and returns the first element of the List, or returns
+// ErrNotFound if the List is empty.
+func (l *List) PopFront() ([]byte, error) {
+	return l.pop(true)
+}
+
+func (l *List) pop(front bool) ([]byte, error) {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	var value []byte
+	err := l.db.update(func() error {
+		head, tail, err := l.ends()
+		if nil != err {
+			return err
+		}
+		if head == tail {
+			return ErrNotFound
+		}
+		pos := tail - 1
+		if front {
+			pos = head
+			head++
+		} else {
+			tail--
+		}
+		key := l.elementKey(pos)
+		if value, err = l.db.getElement(key); nil != err {
+			return err
+		}
+		if err = l.db.delete(key); nil != err {
+			return err
+		}
+		return l.setEnds(head, tail)
+	})
+	if nil != err {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Len returns the number of elements in the List.
+func (l *List) Len() (int, error) {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	head, tail, err := l.ends()
+	return int(tail - head), err
+}
+
+// position returns the position of the element at the index, counting
+// back from the end of the List if the index is negative.
+//
+// The database lock must be held.
+func (l *List) position(index int) (int64, error) {
+	head, tail, err := l.ends()
+	if nil != err {
+		return 0, err
+	}
+	pos := head + int64(index)
+	if 0 > index {
+		pos = tail + int64(index)
+	}
+	if pos < head || pos >= tail {
+		return 0, ErrIndexOutOfRange
+	}
+	return pos, nil
+}
+
+// Index returns the element at the index, which counts back from the end
+// of the List if it is negative.
+func (l *List) Index(index int) ([]byte, error) {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	pos, err := l.position(index)
+	if nil != err {
+		return nil, err
+	}
+	return l.db.getElement(l.elementKey(pos))
+}
+
+// SetIndex replaces the element at the index, which counts back from the
+// end of the List if it is negative.
+func (l *List) SetIndex(index int, value []byte) error {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	pos, err := l.position(index)
+	if nil != err {
+		return err
+	}
+	return l.db.setElement(l.elementKey(pos), value)
+}
+
+// Range returns the elements from start to stop, inclusive. Negative
+// indexes count back from the end of the List, so Range(0, -1) returns
+// every element.
+func (l *List) Range(start, stop int) ([][]byte, error) {
+	l.db.lock.Lock()
+	defer l.db.lock.Unlock()
+	head, tail, err := l.ends()
+	if nil != err {
+		return nil, err
+	}
+	from, to := head+int64(start), head+int64(stop)
+	if 0 > start {
+		from = tail + int64(start)
+	}
+	if 0 > stop {
+		to = tail + int64(stop)
+	}
+	if from < head {
+		from = head
+	}
+	if to >= tail {
+		to = tail - 1
+	}
+	var values [][]byte
+	for pos := from; pos <= to; pos++ {
+		value, err := l.db.getElement(l.elementKey(pos))
+		if nil != err {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
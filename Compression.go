@@ -0,0 +1,184 @@
+package gophia
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressor is an algorithm for compressing values. Each Compressor is
+// identified by a marker byte, which is stored as the first byte of
+// every value it compresses.
+type Compressor interface {
+	// Marker returns the byte identifying values compressed by
+	// this Compressor.
+	Marker() byte
+	// Compress compresses the value.
+	Compress(value []byte) ([]byte, error)
+	// Decompress reverses Compress.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// uncompressedMarker is prefixed to values stored uncompressed whose
+// first byte would otherwise be mistaken for a marker.
+//
+// Markers are chosen from the bytes that never occur in valid UTF-8
+// (0xc0, 0xc1 and 0xf5-0xff), so that legacy text values, including
+// JSON, are never mistaken for compressed values. Markers for other
+// Compressors should be chosen from the same bytes.
+const uncompressedMarker byte = 0xc0
+
+var (
+	// FlateCompressor compresses values with DEFLATE.
+	FlateCompressor Compressor = flateCompressor{}
+	// GzipCompressor compresses values with gzip.
+	GzipCompressor Compressor = gzipCompressor{}
+)
+
+// ErrCompressorMarker is returned when registering a Compressor whose
+// marker is already in use.
+var ErrCompressorMarker = errors.New("Compressor marker already in use")
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[byte]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(FlateCompressor)
+	RegisterCompressor(GzipCompressor)
+}
+
+// RegisterCompressor makes a Compressor available for decompressing
+// values. A Compressor must be registered before it is used to
+// Compress a Database, and before any value it compressed is read.
+func RegisterCompressor(c Compressor) error {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	m := c.Marker()
+	if _, ok := compressors[m]; ok || uncompressedMarker == m {
+		return ErrCompressorMarker
+	}
+	compressors[m] = c
+	return nil
+}
+
+// compressorFor returns the registered Compressor for the marker,
+// or nil if there is none.
+func compressorFor(marker byte) Compressor {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	return compressors[marker]
+}
+
+// Compress compresses values with the algorithm before they are stored.
+// Values shorter than threshold, and values that do not shrink, are
+// stored uncompressed.
+//
+// Values written before compression was enabled still read correctly,
+// unless their first byte is the marker of a registered Compressor
+// (0xc0, 0xc1 and 0xf5 for the built-in algorithms), which is never the
+// case for UTF-8 text.
+//
+// Compress adds a ValueCodec to the database, so the order in which it
+// is called relative to other codecs matters: see AddCodec.
+func (db *Database) Compress(algorithm Compressor, threshold int) error {
+	if nil == compressorFor(algorithm.Marker()) {
+		return fmt.Errorf("Compressor with marker %#x is not registered", algorithm.Marker())
+	}
+	db.AddCodec(&compressionCodec{algorithm, threshold})
+	return nil
+}
+
+// compressionCodec is the ValueCodec that implements Compress.
+type compressionCodec struct {
+	algorithm Compressor
+	threshold int
+}
+
+func (c *compressionCodec) Encode(key, value []byte) ([]byte, error) {
+	if len(value) >= c.threshold {
+		data, err := c.algorithm.Compress(value)
+		if nil != err {
+			return nil, err
+		}
+		if len(data)+1 < len(value) {
+			return append([]byte{c.algorithm.Marker()}, data...), nil
+		}
+	}
+	if 0 < len(value) && (uncompressedMarker == value[0] || nil != compressorFor(value[0])) {
+		return append([]byte{uncompressedMarker}, value...), nil
+	}
+	return value, nil
+}
+
+func (c *compressionCodec) Decode(key, value []byte) ([]byte, error) {
+	if 0 == len(value) {
+		return value, nil
+	}
+	if uncompressedMarker == value[0] {
+		return value[1:], nil
+	}
+	if algorithm := compressorFor(value[0]); nil != algorithm {
+		return algorithm.Decompress(value[1:])
+	}
+	return value, nil
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Marker() byte {
+	return 0xc1
+}
+
+func (flateCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if nil != err {
+		return nil, err
+	}
+	if _, err = w.Write(value); nil != err {
+		return nil, err
+	}
+	if err = w.Close(); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Marker() byte {
+	return 0xf5
+}
+
+func (gzipCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); nil != err {
+		return nil, err
+	}
+	if err := w.Close(); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
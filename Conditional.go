@@ -0,0 +1,75 @@
+package gophia
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrEmptyValue is returned when setting a key to an empty value, which
+// Sophia cannot store.
+var ErrEmptyValue = errors.New("Value must not be empty")
+
+// setIf sets the value of the key if cond returns true for the key's
+// current value, with any deferred merges applied, and returns whether it
+// did. The key keeps its expiry time. A nil value deletes the key.
+func (db *Database) setIf(key, value []byte, cond func(current []byte, exists bool) bool) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	current, expires, exists, err := db.live(key)
+	if nil != err || !cond(current, exists) {
+		return false, err
+	}
+	if !exists {
+		expires = 0
+	}
+	if nil == value {
+		err = db.remove(key)
+	} else {
+		err = db.store(key, value, expires)
+	}
+	return nil == err, err
+}
+
+// CompareAndSwap atomically sets the value of the key to value if its
+// current value is old, and returns whether it did. The key keeps its
+// expiry time. The value must not be empty: use DeleteIfEquals to
+// delete the key.
+func (db *Database) CompareAndSwap(key, old, value []byte) (bool, error) {
+	if 0 == len(value) {
+		return false, ErrEmptyValue
+	}
+	return db.setIf(key, value, func(current []byte, exists bool) bool {
+		return exists && bytes.Equal(current, old)
+	})
+}
+
+// DeleteIfEquals atomically deletes the key if its current value is
+// value, and returns whether it did.
+func (db *Database) DeleteIfEquals(key, value []byte) (bool, error) {
+	return db.setIf(key, nil, func(current []byte, exists bool) bool {
+		return exists && bytes.Equal(current, value)
+	})
+}
+
+// Replace atomically sets the value of the key only if the key already
+// exists, and returns whether it did. The key keeps its expiry time. The
+// value must not be empty.
+func (db *Database) Replace(key, value []byte) (bool, error) {
+	if 0 == len(value) {
+		return false, ErrEmptyValue
+	}
+	return db.setIf(key, value, func(_ []byte, exists bool) bool {
+		return exists
+	})
+}
+
+// SetIfAbsent atomically sets the value of the key only if the key does
+// not exist, and returns whether it did. The value must not be empty.
+func (db *Database) SetIfAbsent(key, value []byte) (bool, error) {
+	if 0 == len(value) {
+		return false, ErrEmptyValue
+	}
+	return db.setIf(key, value, func(_ []byte, exists bool) bool {
+		return !exists
+	})
+}
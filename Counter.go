@@ -0,0 +1,138 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Counters are stored as a type byte followed by the 8 byte big-endian
+// value: a two's complement int64, or the IEEE 754 bits of a float64.
+const (
+	counterInt   byte = 'i'
+	counterFloat byte = 'f'
+	counterSize       = 9
+)
+
+// ErrNotCounter is returned when incrementing or reading a counter whose
+// stored value is not a counter of the right type.
+var ErrNotCounter = errors.New("Value is not a counter of the requested type")
+
+// encodeCounter returns the stored form of a counter.
+func encodeCounter(kind byte, bits uint64) []byte {
+	value := make([]byte, counterSize)
+	value[0] = kind
+	binary.BigEndian.PutUint64(value[1:], bits)
+	return value
+}
+
+// decodeCounter returns the bits of a stored counter of the kind.
+func decodeCounter(kind byte, value []byte) (uint64, error) {
+	if counterSize != len(value) || kind != value[0] {
+		return 0, ErrNotCounter
+	}
+	return binary.BigEndian.Uint64(value[1:]), nil
+}
+
+// addCounter adds to the counter stored under the key, which is created
+// if it does not exist, and returns the new bits of the counter. add is
+// called with the current bits of the counter, or 0 for a new counter.
+// Any expiry time of the key is kept.
+func (db *Database) addCounter(key []byte, kind byte, add func(bits uint64) uint64) (uint64, error) {
+	var bits uint64
+	value, expires, exists, err := db.live(key)
+	switch {
+	case nil != err:
+		return 0, err
+	case !exists:
+		expires = 0
+	default:
+		if bits, err = decodeCounter(kind, value); nil != err {
+			return 0, err
+		}
+	}
+	bits = add(bits)
+	return bits, db.store(key, encodeCounter(kind, bits), expires)
+}
+
+// Increment atomically adds delta to the int64 counter stored under the
+// key, creating the counter if it does not exist, and returns the new
+// value.
+func (db *Database) Increment(key []byte, delta int64) (int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	bits, err := db.addCounter(key, counterInt, func(bits uint64) uint64 {
+		return uint64(int64(bits) + delta)
+	})
+	return int64(bits), err
+}
+
+// Decrement atomically subtracts delta from the int64 counter stored
+// under the key. See Increment.
+func (db *Database) Decrement(key []byte, delta int64) (int64, error) {
+	return db.Increment(key, -delta)
+}
+
+// IncrementFloat atomically adds delta to the float64 counter stored
+// under the key, creating the counter if it does not exist, and returns
+// the new value.
+func (db *Database) IncrementFloat(key []byte, delta float64) (float64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	bits, err := db.addCounter(key, counterFloat, func(bits uint64) uint64 {
+		return math.Float64bits(math.Float64frombits(bits) + delta)
+	})
+	return math.Float64frombits(bits), err
+}
+
+// DecrementFloat atomically subtracts delta from the float64 counter
+// stored under the key. See IncrementFloat.
+func (db *Database) DecrementFloat(key []byte, delta float64) (float64, error) {
+	return db.IncrementFloat(key, -delta)
+}
+
+// IncrementMany atomically adds each delta to the int64 counter stored
+// under its key, in a single transaction, and returns the new values.
+// If any counter cannot be incremented, none are.
+func (db *Database) IncrementMany(deltas map[string]int64) (map[string]int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	values := make(map[string]int64, len(deltas))
+	err := db.update(func() error {
+		for key, delta := range deltas {
+			bits, err := db.addCounter([]byte(key), counterInt, func(bits uint64) uint64 {
+				return uint64(int64(bits) + delta)
+			})
+			if nil != err {
+				return err
+			}
+			values[key] = int64(bits)
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Counter returns the value of the int64 counter stored under the key.
+func (db *Database) Counter(key []byte) (int64, error) {
+	value, err := db.Get(key)
+	if nil != err {
+		return 0, err
+	}
+	bits, err := decodeCounter(counterInt, value)
+	return int64(bits), err
+}
+
+// FloatCounter returns the value of the float64 counter stored under the
+// key.
+func (db *Database) FloatCounter(key []byte) (float64, error) {
+	value, err := db.Get(key)
+	if nil != err {
+		return 0, err
+	}
+	bits, err := decodeCounter(counterFloat, value)
+	return math.Float64frombits(bits), err
+}
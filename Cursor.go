@@ -1,6 +1,7 @@
 package gophia
 
 import (
+	"bytes"
 	"fmt"
 	"unsafe"
 )
@@ -15,19 +16,56 @@ import "C"
 // Cursor iterates over key-values in a database.
 type Cursor struct {
 	unsafe.Pointer
+	db     *Database
+	prefix []byte
+	// raw cursors return every row as it is stored.
+	raw bool
+	err error
 }
 
 // Close closes the cursor. If a cursor is not closed, future operations
 // on the database can hang indefinitely.
 func (cur *Cursor) Close() error {
+	if nil == cur.Pointer {
+		return nil
+	}
+	if !cur.raw {
+		cur.db.lock.Lock()
+		defer cur.db.lock.Unlock()
+		cur.db.cursors--
+	}
+	return sp_close(&cur.Pointer)
+}
+
+// close closes a cursor opened with Database.cursor.
+func (cur *Cursor) close() error {
 	return sp_close(&cur.Pointer)
 }
 
 // Fetch fetches the next row for the cursor, and returns
 // true if there is a next row, false if the cursor has reached the
 // end of the rows.
+//
+// Keys that gophia uses internally, and keys that have expired, are
+// skipped. A Bucket's Cursor reaches the end of its rows at the end of
+// the Bucket.
 func (cur *Cursor) Fetch() bool {
-	return C.int(1) == C.sp_fetch(cur.Pointer)
+	for C.int(1) == C.sp_fetch(cur.Pointer) {
+		if cur.raw {
+			return true
+		}
+		key := cur.keyView()
+		if nil != cur.prefix && !bytes.HasPrefix(key, cur.prefix) {
+			return false
+		}
+		if nil == cur.prefix && isHiddenKey(key) {
+			continue
+		}
+		if expires, _ := cur.db.splitExpiry(cur.valueView()); !expired(expires) {
+			return true
+		}
+	}
+	return false
 }
 
 // Key returns the current key of the cursor.
@@ -37,25 +75,51 @@ func (cur *Cursor) Key() []byte {
 		fmt.Println("Key is 0 len")
 		return nil
 	}
-	return C.GoBytes(unsafe.Pointer(C.sp_key(cur.Pointer)), size)
+	return C.GoBytes(unsafe.Pointer(C.sp_key(cur.Pointer)), size)[len(cur.prefix):]
+}
+
+// keyView returns the current key without copying it. The key is only
+// valid until the cursor moves.
+func (cur *Cursor) keyView() []byte {
+	return cBytesView((*C.char)(unsafe.Pointer(C.sp_key(cur.Pointer))), C.sp_keysize(cur.Pointer))
 }
 
 // KeySize returns the size of the current key.
 func (cur *Cursor) KeySize() int {
-	return int(C.sp_keysize(cur.Pointer))
+	return int(C.sp_keysize(cur.Pointer)) - len(cur.prefix)
+}
+
+// Err returns the error, if any, that occurred decoding a value
+// with the database's ValueCodecs.
+func (cur *Cursor) Err() error {
+	return cur.err
 }
 
-// Value returns the current value of the cursor.
+// Value returns the current value of the cursor. If the value cannot be
+// decoded by the database's ValueCodecs, Value returns nil and the
+// error is available from Err().
 func (cur *Cursor) Value() []byte {
 	size := C.int(C.sp_valuesize(cur.Pointer))
 	if 0 == size {
 		fmt.Println("Value is 0 len")
 		return nil
 	}
-	return C.GoBytes(unsafe.Pointer(C.sp_value(cur.Pointer)), size)
+	value := C.GoBytes(unsafe.Pointer(C.sp_value(cur.Pointer)), size)
+	if cur.raw {
+		return value
+	}
+	value, _, cur.err = cur.db.decodeStored(cur.keyView(), value)
+	return value
+}
+
+// valueView returns the current stored value without copying it. The
+// value is only valid until the cursor moves.
+func (cur *Cursor) valueView() []byte {
+	return cBytesView((*C.char)(unsafe.Pointer(C.sp_value(cur.Pointer))), C.sp_valuesize(cur.Pointer))
 }
 
-// ValueSize returns the length of the current value.
+// ValueSize returns the length of the current value, as stored in
+// the database.
 func (cur *Cursor) ValueSize() int {
 	return int(C.sp_valuesize(cur.Pointer))
 }
@@ -3,6 +3,7 @@ package gophia
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"unsafe"
 )
 
@@ -29,14 +30,51 @@ const (
 
 // ErrNotFound indicates that the key does not exist in the database.
 var ErrNotFound = errors.New("Key not found")
+
 // ErrTransactionInProgress returned when attempt to begin a transaction while there is already
 // a transaction in progress.
 var ErrTransactionInProgress = errors.New("Transaction already in progress")
 
 // Database is used for accessing a database.
+//
+// Each method call on a Database is serialized with the others, and with
+// gophia's own background work, such as the expiry sweeper.
 type Database struct {
 	unsafe.Pointer
-	env *Environment
+	env      *Environment
+	dir      string
+	readOnly bool
+	order    keyOrder
+
+	// lock serializes calls into Sophia. Exported methods take the lock,
+	// and call unexported methods that expect it to be held.
+	lock     sync.Mutex
+	tx       bool
+	cursors  int
+	codecs   []ValueCodec
+	indexes  map[string]IndexFunc
+	expiring bool
+	sweeper  *sweeper
+
+	mergeOps      []mergeOperator
+	deferMerges   bool
+	pendingMerges bool
+	mergeSeq      uint64
+
+	queues map[string]*Queue
+
+	textIndexes map[string]*textIndex
+	downsampler *sweeper
+
+	versioning  *VersionPolicy
+	versionTime int64
+
+	softDeletes bool
+	purger      *sweeper
+
+	bloom  *bloomFilter
+	cache  *cache
+	layers []rawLayer
 }
 
 // Begin starts a multi-statement transaction.
@@ -47,8 +85,18 @@ type Database struct {
 
 // No nested transactions are supported.
 func (db *Database) Begin() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.begin()
+}
+
+func (db *Database) begin() error {
+	if db.tx {
+		return ErrTransactionInProgress
+	}
 	switch C.sp_begin(db.Pointer) {
 	case 0:
+		db.tx = true
 		return nil
 	case 1:
 		return ErrTransactionInProgress
@@ -62,24 +110,45 @@ func (db *Database) Begin() error {
 // Close closes the database and frees its associated memory. You must
 // call Close on any database opened with Open()
 func (db *Database) Close() error {
+	db.StopSweeper()
+	db.StopDownsampler()
+	db.StopPurger()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var saveErr error
+	if nil != db.bloom && "" != db.dir && !db.readOnly {
+		saveErr = db.saveBloomFilter()
+	}
 	err := sp_close(&db.Pointer)
 	if nil != err {
 		return err
 	}
 	if nil != db.env {
-		return db.env.Close()
+		if err = db.env.Close(); nil != err {
+			return err
+		}
 	}
-	return nil
+	return saveErr
 }
 
 // Commit applies changes to a multi-statement
-// transaction. All modifications made during the transaction are written to 
+// transaction. All modifications made during the transaction are written to
 // the log file in a single batch.
 //
 // If commit failed, transaction modifications are discarded.
 func (db *Database) Commit() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.commit()
+}
+
+func (db *Database) commit() error {
 	e := C.sp_commit(db.Pointer)
-	if 0!=e {
+	db.tx = false
+	for _, l := range db.layers {
+		l.endTx(0 == e)
+	}
+	if 0 != e {
 		return db.Error()
 	}
 	return nil
@@ -94,8 +163,21 @@ func (db *Database) Commit() error {
 //
 // Iterate over values with Fetch or Next methods.
 func (db *Database) Cursor(order Order, key []byte) (*Cursor, error) {
-	cur := &Cursor{}
-	if nil == key {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	cur, err := db.cursor(order, key)
+	if nil != err {
+		return nil, err
+	}
+	db.cursors++
+	return cur, nil
+}
+
+// cursor returns a Cursor that is not counted as open by the database,
+// for gophia's own short-lived iterations.
+func (db *Database) cursor(order Order, key []byte) (*Cursor, error) {
+	cur := &Cursor{db: db}
+	if 0 == len(key) {
 		cur.Pointer = C.sp_cursor(db.Pointer, C.sporder(order), unsafe.Pointer(nil), C.size_t(0))
 	} else {
 		cur.Pointer = C.sp_cursor(db.Pointer, C.sporder(order), unsafe.Pointer(&key[0]), C.size_t(len(key)))
@@ -108,6 +190,20 @@ func (db *Database) Cursor(order Order, key []byte) (*Cursor, error) {
 
 // Delete deletes the key from the database.
 func (db *Database) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.remove(key)
+}
+
+// remove deletes the key, calling the writeHooks.
+func (db *Database) remove(key []byte) error {
+	return db.apply(&write{key: key, deleted: true})
+}
+
+// delete deletes the key from the database, bypassing any gophia
+// layers.
+func (db *Database) delete(key []byte) error {
+	db.written(key, nil)
 	if 0 != C.sp_delete(db.Pointer, unsafe.Pointer(&key[0]), C.size_t(len(key))) {
 		return db.Error()
 	}
@@ -123,14 +219,52 @@ func (db *Database) Error() error {
 
 // Get retrieves the value for the key.
 func (db *Database) Get(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.pendingMerges {
+		value, _, exists, err := db.merged(key)
+		if nil == err && !exists {
+			err = ErrNotFound
+		}
+		return value, err
+	}
+	value, expires, err := db.load(key)
+	if nil != err {
+		return nil, err
+	}
+	if expired(expires) {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// load retrieves the value for the key, decoded by the ValueCodecs, and
+// its expiry time, whether or not the key has expired.
+func (db *Database) load(key []byte) ([]byte, int64, error) {
+	stored, err := db.get(key)
+	if nil != err {
+		return nil, 0, err
+	}
+	return db.decodeStored(key, stored)
+}
+
+// get retrieves the value for the key, bypassing any gophia layers.
+func (db *Database) get(key []byte) ([]byte, error) {
 	var vptr unsafe.Pointer
 	var size C.size_t
 
+	if value, found, ok := db.lookup(key); ok {
+		if !found {
+			return nil, ErrNotFound
+		}
+		return value, nil
+	}
 	e := C.sp_get(db.Pointer, unsafe.Pointer(&key[0]), C.size_t(len(key)), &vptr, (*C.size_t)(&size))
 	switch int(e) {
 	case -1:
 		return nil, db.Error()
 	case 0:
+		db.loaded(key, nil)
 		return nil, ErrNotFound
 	case 1:
 		// Continue after the switch
@@ -139,17 +273,42 @@ func (db *Database) Get(key []byte) ([]byte, error) {
 	}
 	value := C.GoBytes(vptr, C.int(size))
 	C.sp_destroy(vptr)
+	db.loaded(key, value)
 	return value, nil
 }
 
-
 // Has returns true if the database has a value for the key.
 func (db *Database) Has(key []byte) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.has(key)
+}
+
+func (db *Database) has(key []byte) (bool, error) {
+	if db.pendingMerges {
+		_, _, exists, err := db.merged(key)
+		return exists, err
+	}
+	if db.expiring {
+		stored, err := db.get(key)
+		if ErrNotFound == err {
+			return false, nil
+		}
+		if nil != err {
+			return false, err
+		}
+		expires, _ := db.splitExpiry(stored)
+		return !expired(expires), nil
+	}
+	if _, found, ok := db.lookup(key); ok {
+		return found, nil
+	}
 	e := C.sp_get(db.Pointer, unsafe.Pointer(&key[0]), C.size_t(len(key)), nil, nil)
 	switch int(e) {
 	case -1:
 		return false, db.Error()
 	case 0:
+		db.loaded(key, nil)
 		return false, nil
 	case 1:
 		return true, nil
@@ -158,11 +317,27 @@ func (db *Database) Has(key []byte) (bool, error) {
 }
 
 // Rollback discards the changes of a multi-statement
-// transaction. All modifications made during the transaction are not written to 
+// transaction. All modifications made during the transaction are not written to
 // the log file.
 func (db *Database) Rollback() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.rollback()
+}
+
+func (db *Database) rollback() error {
 	e := C.sp_rollback(db.Pointer)
-	if 0!=e {
+	db.tx = false
+	if db.expiring {
+		// The expiryFlag may have been set in the transaction.
+		if flag, err := db.hasExpiryFlag(); nil == err {
+			db.expiring = flag
+		}
+	}
+	for _, l := range db.layers {
+		l.endTx(false)
+	}
+	if 0 != e {
 		return db.Error()
 	}
 	return nil
@@ -170,6 +345,43 @@ func (db *Database) Rollback() error {
 
 // Set sets the value of the key.
 func (db *Database) Set(key, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.store(key, value, 0)
+}
+
+// store encodes the value with the ValueCodecs and stores it with its
+// expiry time, calling the writeHooks.
+func (db *Database) store(key, value []byte, expires int64) error {
+	return db.apply(&write{key: key, value: value, expires: expires})
+}
+
+// rewrite stores the value as store does, as a maintenance rewrite of the
+// key's value, which adds no version.
+func (db *Database) rewrite(key, value []byte, expires int64) error {
+	return db.apply(&write{key: key, value: value, expires: expires, rewrite: true})
+}
+
+// update calls fn inside a transaction. If a transaction is already in
+// progress, fn joins it. Otherwise the transaction is committed if fn
+// succeeds, and rolled back if it fails.
+func (db *Database) update(fn func() error) error {
+	if db.tx {
+		return fn()
+	}
+	if err := db.begin(); nil != err {
+		return err
+	}
+	if err := fn(); nil != err {
+		db.rollback()
+		return err
+	}
+	return db.commit()
+}
+
+// set stores the value for the key, bypassing any gophia layers.
+func (db *Database) set(key, value []byte) error {
+	db.written(key, value)
 	e := C.sp_set(db.Pointer, unsafe.Pointer(&key[0]), C.size_t(len(key)), unsafe.Pointer(&value[0]), C.size_t(len(value)))
 	if 0 != e {
 		return db.Error()
@@ -0,0 +1,314 @@
+package gophia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Collection is a set of JSON documents, stored in the top-level Bucket
+// with the Collection's name.
+type Collection struct {
+	bucket *Bucket
+	name   string
+}
+
+// Document is a JSON document in a Collection.
+type Document struct {
+	ID   []byte
+	JSON json.RawMessage
+}
+
+// Decode unmarshals the Document's JSON into out.
+func (d Document) Decode(out interface{}) error {
+	return json.Unmarshal(d.JSON, out)
+}
+
+// Collection returns the named Collection, creating it if it does not
+// exist.
+func (db *Database) Collection(name string) (*Collection, error) {
+	b, err := db.Bucket(name)
+	if nil != err {
+		return nil, err
+	}
+	return &Collection{bucket: b, name: name}, nil
+}
+
+// Put marshals doc to JSON, and stores it under the id.
+func (c *Collection) Put(id []byte, doc interface{}) error {
+	buf, err := json.Marshal(doc)
+	if nil != err {
+		return err
+	}
+	return c.PutJSON(id, buf)
+}
+
+// PutJSON stores the JSON document under the id.
+func (c *Collection) PutJSON(id, doc []byte) error {
+	if !json.Valid(doc) {
+		return errors.New("Invalid JSON document")
+	}
+	return c.bucket.Set(id, doc)
+}
+
+// Get unmarshals the document stored under the id into out.
+func (c *Collection) Get(id []byte, out interface{}) error {
+	buf, err := c.bucket.Get(id)
+	if nil != err {
+		return err
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// Delete deletes the document stored under the id.
+func (c *Collection) Delete(id []byte) error {
+	return c.bucket.Delete(id)
+}
+
+// indexName returns the name of the secondary index of the field path.
+func (c *Collection) indexName(path string) string {
+	return "doc\x00" + c.name + "\x00" + path
+}
+
+// AddIndex adds a secondary index on the dotted field path, which Find
+// uses for predicates on the path. As with Database.AddIndex, the index
+// must be added each time the database is opened, and documents stored
+// while it was not added are only indexed by RebuildIndex.
+func (c *Collection) AddIndex(path string) {
+	prefix := c.bucket.rows
+	c.bucket.db.AddIndex(c.indexName(path), func(key, value []byte) [][]byte {
+		if !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+		var doc interface{}
+		if err := json.Unmarshal(value, &doc); nil != err {
+			return nil
+		}
+		return fieldValues(doc, path)
+	})
+}
+
+// RebuildIndex rebuilds the secondary index on the dotted field path.
+func (c *Collection) RebuildIndex(path string) error {
+	return c.bucket.db.RebuildIndex(c.indexName(path))
+}
+
+// fieldValues returns the order-preserving encodings of the values at
+// the dotted path in the document. Path segments index into objects by
+// name and into arrays by position. An array at the end of the path
+// yields each of its elements, and null values are left out.
+func fieldValues(doc interface{}, path string) [][]byte {
+	for _, seg := range strings.Split(path, ".") {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			doc = d[seg]
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if nil != err || 0 > i || i >= len(d) {
+				return nil
+			}
+			doc = d[i]
+		default:
+			return nil
+		}
+	}
+	if a, ok := doc.([]interface{}); ok {
+		var values [][]byte
+		for _, v := range a {
+			if e := encodeField(v); nil != e {
+				values = append(values, e)
+			}
+		}
+		return values
+	}
+	if e := encodeField(doc); nil != e {
+		return [][]byte{e}
+	}
+	return nil
+}
+
+// encodeField returns the order-preserving encoding of a JSON string,
+// number or boolean, or nil for any other value. Numbers of any Go
+// numeric type are encoded as float64, so that they compare with the
+// numbers decoded from JSON.
+func encodeField(v interface{}) []byte {
+	f := reflect.ValueOf(v)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v = float64(f.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v = float64(f.Uint())
+	case reflect.Float32, reflect.Float64:
+		v = f.Float()
+	case reflect.String:
+		v = f.String()
+	case reflect.Bool:
+		v = f.Bool()
+	default:
+		return nil
+	}
+	e, _ := EncodeKey(v)
+	return e
+}
+
+// fieldType returns the first type code of the JSON type of an encoded
+// field. Booleans have a type code for each value, but are the same JSON
+// type.
+func fieldType(value []byte) byte {
+	if keyTrue == value[0] {
+		return keyFalse
+	}
+	return value[0]
+}
+
+// Predicate is a condition on a dotted field path of a document. A
+// document matches if any of the values at the path satisfies the
+// condition. Values only compare with values of the same JSON type.
+type Predicate struct {
+	Path  string
+	Op    string
+	Value interface{}
+}
+
+// Eq matches documents whose field equals the value.
+func Eq(path string, value interface{}) Predicate { return Predicate{path, "=", value} }
+
+// Lt matches documents whose field is less than the value.
+func Lt(path string, value interface{}) Predicate { return Predicate{path, "<", value} }
+
+// Lte matches documents whose field is less than or equal to the value.
+func Lte(path string, value interface{}) Predicate { return Predicate{path, "<=", value} }
+
+// Gt matches documents whose field is greater than the value.
+func Gt(path string, value interface{}) Predicate { return Predicate{path, ">", value} }
+
+// Gte matches documents whose field is greater than or equal to the
+// value.
+func Gte(path string, value interface{}) Predicate { return Predicate{path, ">=", value} }
+
+// match returns true if the document satisfies the predicate.
+func (p Predicate) match(doc interface{}, value []byte) bool {
+	for _, v := range fieldValues(doc, p.Path) {
+		if fieldType(v) != fieldType(value) {
+			continue
+		}
+		c := bytes.Compare(v, value)
+		switch p.Op {
+		case "=":
+			if 0 == c {
+				return true
+			}
+		case "<":
+			if 0 > c {
+				return true
+			}
+		case "<=":
+			if 0 >= c {
+				return true
+			}
+		case ">":
+			if 0 < c {
+				return true
+			}
+		case ">=":
+			if 0 <= c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bounds returns the range of index values that can satisfy the
+// predicate, from start (inclusive) to end (exclusive).
+func (p Predicate) bounds(value []byte) ([]byte, []byte) {
+	// The values of the same type as the predicate's value lie between
+	// its first type code and the next type's.
+	first, last := []byte{fieldType(value)}, []byte{value[0] + 1}
+	if keyFalse == value[0] {
+		last[0] = keyTrue + 1
+	}
+	switch p.Op {
+	case "=":
+		return value, append(append([]byte{}, value...), 0)
+	case "<", "<=":
+		return first, append(append([]byte{}, value...), 0)
+	}
+	return value, last
+}
+
+// Find returns the documents in the Collection that match all the
+// predicates, in ID order when no index is used. If a predicate is on a
+// path with a secondary index, the candidates are read from the index;
+// otherwise every document is scanned.
+func (c *Collection) Find(predicates ...Predicate) ([]Document, error) {
+	values := make([][]byte, len(predicates))
+	for i, p := range predicates {
+		if values[i] = encodeField(p.Value); nil == values[i] {
+			return nil, errors.New("Predicate value must be a string, number or boolean")
+		}
+		switch p.Op {
+		case "=", "<", "<=", ">", ">=":
+		default:
+			return nil, errors.New("Unknown predicate operator " + p.Op)
+		}
+	}
+	var docs []Document
+	add := func(id, buf []byte) error {
+		var doc interface{}
+		if err := json.Unmarshal(buf, &doc); nil != err {
+			return err
+		}
+		for i, p := range predicates {
+			if !p.match(doc, values[i]) {
+				return nil
+			}
+		}
+		docs = append(docs, Document{append([]byte{}, id...), append(json.RawMessage{}, buf...)})
+		return nil
+	}
+
+	db := c.bucket.db
+	for i, p := range predicates {
+		name := c.indexName(p.Path)
+		if !db.hasIndex(name) {
+			continue
+		}
+		// A document with several matching values is indexed under each.
+		seen := map[string]bool{}
+		start, end := p.bounds(values[i])
+		err := db.ScanIndex(name, start, end, func(_, key []byte) error {
+			if seen[string(key)] {
+				return nil
+			}
+			seen[string(key)] = true
+			buf, err := db.Get(key)
+			if ErrNotFound == err {
+				return nil
+			}
+			if nil != err {
+				return err
+			}
+			return add(key[len(c.bucket.rows):], buf)
+		})
+		return docs, err
+	}
+
+	cur, err := c.bucket.Cursor(GTE, nil)
+	if nil != err {
+		return nil, err
+	}
+	defer cur.Close()
+	for cur.Fetch() {
+		if err = add(cur.Key(), cur.Value()); nil != err {
+			return nil, err
+		}
+	}
+	if err = cur.Err(); nil != err {
+		return nil, err
+	}
+	return docs, nil
+}
@@ -0,0 +1,274 @@
+package gophia
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// encryptedMarker is the first byte of every encrypted value. It is
+// followed by the 4 byte big-endian key ID, the nonce and the sealed
+// value. The byte never occurs in UTF-8, so plaintext values are not
+// mistaken for encrypted ones.
+const encryptedMarker byte = 0xf6
+
+// encryptedHeaderSize is the size of the marker and the key ID.
+const encryptedHeaderSize = 5
+
+var (
+	// ErrUnknownKey is returned when a value was encrypted with a key
+	// that is not in the Keyring.
+	ErrUnknownKey = errors.New("Encryption key not found in keyring")
+	// ErrNoPrimaryKey is returned when encrypting with a Keyring that
+	// has no primary key.
+	ErrNoPrimaryKey = errors.New("Keyring has no primary key")
+	// ErrNotEncrypted is returned when reading a value that is not
+	// encrypted, and the Keyring does not allow plaintext.
+	ErrNotEncrypted = errors.New("Value is not encrypted")
+)
+
+// Keyring holds the AES keys used to encrypt values at rest. Values are
+// sealed with AES-GCM, using the primary key, and the value's database key
+// as additional data, so a sealed value cannot be moved to another key.
+//
+// Values are read with whichever key they were written with, so keys
+// can be rotated by adding a new key, making it the primary, calling
+// Database.Reencrypt, and then removing the old key.
+//
+// A Keyring is a ValueCodec: set it on a Database with Encrypt.
+type Keyring struct {
+	// Plaintext allows values without an encryption header to be read
+	// as plaintext. Set it to encrypt an existing database with
+	// Database.Reencrypt.
+	Plaintext bool
+
+	lock       sync.RWMutex
+	keys       map[uint32]cipher.AEAD
+	primary    uint32
+	hasPrimary bool
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[uint32]cipher.AEAD{}}
+}
+
+// AddKey adds the AES key, which must be 16, 24 or 32 bytes long, with
+// the given ID. The first key added becomes the primary key.
+func (ring *Keyring) AddKey(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if nil != err {
+		return err
+	}
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	ring.keys[id] = aead
+	if !ring.hasPrimary {
+		ring.primary, ring.hasPrimary = id, true
+	}
+	return nil
+}
+
+// RemoveKey removes the key from the Keyring. Values encrypted with the
+// key can no longer be read.
+func (ring *Keyring) RemoveKey(id uint32) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	delete(ring.keys, id)
+	if ring.primary == id {
+		ring.hasPrimary = false
+	}
+}
+
+// SetPrimary sets the key used to encrypt new values.
+func (ring *Keyring) SetPrimary(id uint32) error {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	if _, ok := ring.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	ring.primary, ring.hasPrimary = id, true
+	return nil
+}
+
+// Encode seals the value with the primary key.
+func (ring *Keyring) Encode(key, value []byte) ([]byte, error) {
+	ring.lock.RLock()
+	id, aead := ring.primary, ring.keys[ring.primary]
+	hasPrimary := ring.hasPrimary
+	ring.lock.RUnlock()
+	if !hasPrimary {
+		return nil, ErrNoPrimaryKey
+	}
+	out := make([]byte, encryptedHeaderSize+aead.NonceSize(), encryptedHeaderSize+aead.NonceSize()+len(value)+aead.Overhead())
+	out[0] = encryptedMarker
+	binary.BigEndian.PutUint32(out[1:], id)
+	nonce := out[encryptedHeaderSize:]
+	if _, err := rand.Read(nonce); nil != err {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, value, key), nil
+}
+
+// Decode opens a value sealed by Encode, with the key it was sealed
+// with.
+func (ring *Keyring) Decode(key, value []byte) ([]byte, error) {
+	if len(value) < encryptedHeaderSize || encryptedMarker != value[0] {
+		if ring.Plaintext {
+			return value, nil
+		}
+		return nil, ErrNotEncrypted
+	}
+	ring.lock.RLock()
+	aead, ok := ring.keys[binary.BigEndian.Uint32(value[1:])]
+	ring.lock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	value = value[encryptedHeaderSize:]
+	if len(value) < aead.NonceSize() {
+		return nil, ErrNotEncrypted
+	}
+	return aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], key)
+}
+
+// Encrypt encrypts values in the database with the Keyring. Encrypt
+// adds the Keyring as a ValueCodec, and should normally be called after
+// any other codecs, such as Compress, have been added.
+//
+// Only values are encrypted: keys are stored as they are. The entries of
+// secondary indexes, text indexes and Collection field indexes hold the
+// values they index in their keys, so those values are not encrypted.
+// Do not index values that must be kept secret.
+func (db *Database) Encrypt(ring *Keyring) {
+	db.AddCodec(ring)
+}
+
+// Reencrypt rewrites every value in the database through the
+// database's ValueCodecs, so that every value is encrypted with the
+// current primary key of the database's Keyring. The values gophia
+// stores for its own use, such as Queue messages, Blob chunks, versions,
+// tombstones and deferred merge operands, are rewritten too. It returns
+// the number of values rewritten.
+//
+// Rows are rewritten in batches, without holding a Cursor open while
+// writing. Other calls on the database wait until Reencrypt returns.
+func (db *Database) Reencrypt() (int, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	count := 0
+	err := db.scanRaw(nil, nil, 1000, func(key, stored []byte) error {
+		// The row is rewritten in place, rather than with store, since
+		// its value is unchanged, and storing it would discard any
+		// deferred merges of the key.
+		stored, err := db.reencodeStored(key, stored)
+		if nil != err {
+			return err
+		}
+		if err = db.set(key, stored); nil != err {
+			return err
+		}
+		count++
+		return nil
+	})
+	if nil != err {
+		return count, err
+	}
+	err = db.scanRaw(nil, sysPrefix, 1000, func(entry, stored []byte) error {
+		stored, err := db.reencodeSys(entry, stored)
+		if nil != err || nil == stored {
+			return err
+		}
+		if err = db.set(entry, stored); nil != err {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// reencodeStored returns a value stored under the key, with its expiry
+// time, re-encoded by the ValueCodecs.
+func (db *Database) reencodeStored(key, stored []byte) ([]byte, error) {
+	value, expires, err := db.decodeStored(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	if stored, err = db.encodeValue(key, value); nil != err {
+		return nil, err
+	}
+	return db.joinExpiry(expires, stored), nil
+}
+
+// sysValue locates the encoded value held by a system entry.
+type sysValue struct {
+	// key is the key the value was encoded with.
+	key []byte
+	// header is the number of bytes stored before the value.
+	header int
+	// withExpiry is true if the value is stored as it was under its own
+	// key, with its expiry time.
+	withExpiry bool
+}
+
+// sysValueFunc returns where the value held by a system entry is, given
+// the decoded parts of the entry's key, or false if the entry holds no
+// encoded value.
+type sysValueFunc func(entry []byte, parts []interface{}, stored []byte) (sysValue, bool)
+
+// sysValueFuncs are the sysValueFuncs of gophia's features, by the first
+// part of the keys of their system entries. Each feature registers its
+// own with registerSysValue.
+var sysValueFuncs = map[string]sysValueFunc{}
+
+// registerSysValue registers the sysValueFunc of the system entries whose
+// keys start with the name. It must only be called from init functions.
+func registerSysValue(name string, fn sysValueFunc) {
+	sysValueFuncs[name] = fn
+}
+
+// wholeSysValue is the sysValueFunc of entries holding a value encoded
+// with the entry's own key.
+func wholeSysValue(entry []byte, _ []interface{}, _ []byte) (sysValue, bool) {
+	return sysValue{key: entry}, true
+}
+
+// reencodeSys returns the value of a system entry with the value it
+// holds re-encoded by the ValueCodecs, or nil if the entry holds no
+// encoded value.
+func (db *Database) reencodeSys(entry, stored []byte) ([]byte, error) {
+	parts, err := DecodeKey(entry[len(sysPrefix):])
+	if nil != err || 0 == len(parts) {
+		return nil, err
+	}
+	name, _ := parts[0].(string)
+	fn, ok := sysValueFuncs[name]
+	if !ok {
+		return nil, nil
+	}
+	v, ok := fn(entry, parts, stored)
+	if !ok {
+		return nil, nil
+	}
+	if len(stored) < v.header {
+		return nil, errors.New("Invalid stored value")
+	}
+	var value []byte
+	if v.withExpiry {
+		value, err = db.reencodeStored(v.key, stored[v.header:])
+	} else if value, err = db.decodeValue(v.key, stored[v.header:]); nil == err {
+		value, err = db.encodeValue(v.key, value)
+	}
+	if nil != err {
+		return nil, err
+	}
+	return append(append([]byte{}, stored[:v.header]...), value...), nil
+}
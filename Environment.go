@@ -2,6 +2,7 @@ package gophia
 
 import (
 	"errors"
+	"runtime/cgo"
 	"unsafe"
 )
 
@@ -10,7 +11,8 @@ import (
 #include <sophia.h>
 
 extern int sp_ctl_dir(void *p, uint32_t access, char *dir);
-extern int sp_ctl_cmp(void *p, void *cmp);
+extern int sp_ctl_cmp(void *p, uintptr_t h);
+extern int sp_ctl_cmp_native(void *p, int which);
 extern int sp_ctl_page(void *p, uint32_t count);
 extern int sp_ctl_gc(void *p, int active);
 extern int sp_ctl_gcf(void *p, double factor);
@@ -29,6 +31,10 @@ type Access C.uint32_t
 // the first key parameter is lower, and 1 if the second key
 // parameter is lower.
 //
+// The key slices point directly into Sophia's memory, and are only
+// valid for the duration of the call. They must not be modified or
+// retained.
+//
 // See Environment.Cmp()
 type Comparator func(a []byte, b []byte) int
 
@@ -47,6 +53,11 @@ const (
 // Environment is used to configure the database before opening.
 type Environment struct {
 	unsafe.Pointer
+	cmp    cgo.Handle
+	order  keyOrder
+	access Access
+	dir    string
+	bloom  *BloomConfig
 }
 
 // NewEnvironment creates a new environment for opening a database.
@@ -67,12 +78,16 @@ func (env *Environment) Dir(access Access, directory string) error {
 	if 0 != C.sp_ctl_dir(env.Pointer, C.uint32_t(access), cdir) {
 		return env.Error()
 	}
+	env.access, env.dir = access, directory
 	return nil
 }
 
 // Close closes the enviroment and frees its associated memory. You must call
 // Close on any Environment created with NewEnvironment.
 func (env *Environment) Close() error {
+	// The comparator handle is released even if Sophia fails to close
+	// the environment, since the environment cannot be used again.
+	defer env.releaseCmp()
 	return sp_close(&env.Pointer)
 }
 
@@ -83,9 +98,40 @@ func (env *Environment) Close() error {
 // the first key parameter is lower, and 1 if the second key
 // parameter is lower.
 func (env *Environment) Cmp(cmp Comparator) error {
-	if 0 != C.sp_ctl_cmp(env.Pointer, unsafe.Pointer(&cmp)) {
+	return env.CmpKeys(cmp)
+}
+
+// CmpKeys sets the KeyComparator to use for ordering keys.
+//
+// If cmp is a NativeComparator, the ordering is implemented in C and
+// key comparisons never call into Go.
+//
+// Features that scan ranges of gophia's own keys, such as indexes,
+// expiry times and queues, need the keys ordered bytewise, or bytewise in
+// reverse. With any other ordering they return ErrKeyOrder.
+func (env *Environment) CmpKeys(cmp KeyComparator) error {
+	if native, ok := cmp.(NativeComparator); ok {
+		if 0 != C.sp_ctl_cmp_native(env.Pointer, C.int(native)) {
+			return env.Error()
+		}
+		env.releaseCmp()
+		switch native {
+		case BytesComparator:
+			env.order = bytewiseOrder
+		case ReverseBytesComparator:
+			env.order = reverseOrder
+		default:
+			env.order = customOrder
+		}
+		return nil
+	}
+	h := cgo.NewHandle(cmp)
+	if 0 != C.sp_ctl_cmp(env.Pointer, C.uintptr_t(h)) {
+		h.Delete()
 		return env.Error()
 	}
+	env.releaseCmp()
+	env.cmp, env.order = h, customOrder
 	return nil
 }
 
@@ -164,14 +210,44 @@ func (env *Environment) MergeWM(watermark uint32) error {
 // At a minimum, it should be necessary to call Dir() on the Environment to
 // specify the directory for the database.
 func (env *Environment) Open() (*Database, error) {
-	db := &Database{}
+	db := &Database{order: env.order}
 	db.Pointer = C.sp_open(env.Pointer)
 	if nil == db.Pointer {
 		return nil, env.Error()
 	}
+	expiring, err := db.hasExpiryFlag()
+	if nil != err {
+		sp_close(&db.Pointer)
+		return nil, err
+	}
+	db.expiring = expiring
+	if err = db.loadMerges(); nil != err {
+		sp_close(&db.Pointer)
+		return nil, err
+	}
+	db.dir, db.readOnly = env.dir, 0 != env.access&ReadOnly
+	if nil != env.bloom {
+		err = db.openBloomFilter(*env.bloom)
+	} else if !db.readOnly {
+		// Any saved Bloom filter will miss the keys written now.
+		err = db.dropBloomGeneration()
+	}
+	if nil != err {
+		sp_close(&db.Pointer)
+		return nil, err
+	}
 	return db, nil
 }
 
+// releaseCmp frees the handle of any Go comparator set on the
+// Environment.
+func (env *Environment) releaseCmp() {
+	if 0 != env.cmp {
+		env.cmp.Delete()
+		env.cmp = 0
+	}
+}
+
 // boolToCInt converts a go boolean to a C int value that has
 // boolean meaning
 func boolToCInt(b bool) C.int {
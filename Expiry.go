@@ -0,0 +1,330 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrBatchSize is returned when a batch size is not greater than 0.
+var ErrBatchSize = errors.New("Batch size must be greater than 0")
+
+// expiryMarker is the first byte of a stored value with an expiry time.
+// It is followed by the 8 byte big-endian expiry time, in nanoseconds
+// since the Unix epoch, and then the value as encoded by the
+// ValueCodecs. An expiry time of 0 never expires: it is used to escape
+// values that start with the marker. The byte never occurs in UTF-8.
+//
+// Stored values only have expiry headers once the database has used an
+// expiry time, as recorded by the expiryFlag.
+const expiryMarker byte = 0xf8
+
+// expiryHeaderSize is the size of the marker and the expiry time.
+const expiryHeaderSize = 9
+
+// expiryFlag is the system key recording that stored values in the
+// database may have expiry headers. Until it is set, stored values are
+// never parsed for a header.
+var expiryFlag = sysKey("expiring")
+
+// expiryHeader returns the expiry header for the time.
+func expiryHeader(expires int64) []byte {
+	header := make([]byte, expiryHeaderSize)
+	header[0] = expiryMarker
+	binary.BigEndian.PutUint64(header[1:], uint64(expires))
+	return header
+}
+
+// joinExpiry prefixes the value with its expiry time, if it has one.
+func (db *Database) joinExpiry(expires int64, value []byte) []byte {
+	if !db.expiring || (0 == expires && (0 == len(value) || expiryMarker != value[0])) {
+		return value
+	}
+	return append(expiryHeader(expires), value...)
+}
+
+// splitExpiry returns the expiry time of a stored value, or 0 if it has
+// none, and the value without its expiry time.
+func (db *Database) splitExpiry(stored []byte) (int64, []byte) {
+	if !db.expiring || len(stored) < expiryHeaderSize || expiryMarker != stored[0] {
+		return 0, stored
+	}
+	return int64(binary.BigEndian.Uint64(stored[1:])), stored[expiryHeaderSize:]
+}
+
+// enableExpiry sets the expiryFlag, first escaping every stored value
+// that starts with the expiryMarker, so that values stored before the
+// database used expiry times are not mistaken for expiry headers. The
+// stored values held by tombstones and versions are escaped too.
+//
+// The database lock must be held.
+func (db *Database) enableExpiry() error {
+	escape := func(offset int) func(key, stored []byte) error {
+		return func(key, stored []byte) error {
+			if len(stored) <= offset || expiryMarker != stored[offset] {
+				return nil
+			}
+			escaped := append(append([]byte{}, stored[:offset]...), expiryHeader(0)...)
+			return db.set(key, append(escaped, stored[offset:]...))
+		}
+	}
+	if err := db.scanRaw(nil, nil, 1000, escape(0)); nil != err {
+		return err
+	}
+	if err := db.scanRaw(nil, sysKey("tombstone"), 1000, escape(8)); nil != err {
+		return err
+	}
+	if err := db.scanRaw(nil, sysKey("version"), 1000, escape(1)); nil != err {
+		return err
+	}
+	if err := db.set(expiryFlag, []byte{1}); nil != err {
+		return err
+	}
+	db.expiring = true
+	return nil
+}
+
+// hasExpiryFlag returns true if the expiryFlag is set.
+func (db *Database) hasExpiryFlag() (bool, error) {
+	_, err := db.get(expiryFlag)
+	if ErrNotFound == err {
+		return false, nil
+	}
+	return nil == err, err
+}
+
+// expired returns true if the expiry time has passed.
+func expired(expires int64) bool {
+	return 0 != expires && expires <= time.Now().UnixNano()
+}
+
+// expiryKey returns the key of the system entry recording that the key
+// expires at the time. The sweeper scans these entries in time order.
+func expiryKey(expires int64, key []byte) []byte {
+	return sysKey("expiry", expires, key)
+}
+
+// addExpiry is the writeHook that records when a key written with an
+// expiry time expires, for the sweeper.
+//
+// The database lock must be held, inside a transaction.
+func (db *Database) addExpiry(w *write) error {
+	return db.set(expiryKey(w.expires, w.key), w.key)
+}
+
+// SetWithTTL sets the value of the key, which expires after the ttl.
+// Once a key has expired, Get, Has and Cursors treat it as absent, and
+// the sweeper deletes it.
+//
+// The first time a database uses an expiry time, every stored value is
+// scanned, and values starting with the byte 0xf8 are rewritten with an
+// escape, so that values stored before the database used expiry times
+// still read correctly. Databases that never use expiry times store
+// values without any header.
+func (db *Database) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.store(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire sets the key to expire after the ttl.
+func (db *Database) Expire(key []byte, ttl time.Duration) error {
+	return db.setExpiry(key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist removes any expiry time from the key.
+func (db *Database) Persist(key []byte) error {
+	return db.setExpiry(key, 0)
+}
+
+// setExpiry rewrites the value of the key with the expiry time.
+func (db *Database) setExpiry(key []byte, expires int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	value, _, exists, err := db.live(key)
+	if nil != err {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return db.store(key, value, expires)
+}
+
+// TTL returns the time remaining until the key expires, or 0 if the key
+// does not expire.
+func (db *Database) TTL(key []byte) (time.Duration, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	stored, err := db.get(key)
+	if nil != err {
+		return 0, err
+	}
+	expires, _ := db.splitExpiry(stored)
+	if 0 == expires {
+		return 0, nil
+	}
+	if expired(expires) {
+		return 0, ErrNotFound
+	}
+	return time.Until(time.Unix(0, expires)), nil
+}
+
+// Sweep deletes every expired key, in transactions of at most batch
+// keys, and returns the number of keys deleted. The database is unlocked
+// between transactions, so other callers are not held up for long.
+func (db *Database) Sweep(batch int) (int, error) {
+	if 0 >= batch {
+		return 0, ErrBatchSize
+	}
+	total := 0
+	for {
+		db.lock.Lock()
+		swept, more, err := db.sweepBatch(batch)
+		db.lock.Unlock()
+		total += swept
+		if nil != err || !more {
+			return total, err
+		}
+	}
+}
+
+// sweepBatch deletes the expired keys among the next batch of expiry
+// entries, in a single transaction. It returns the number of keys
+// deleted, and whether there may be more keys to sweep.
+func (db *Database) sweepBatch(batch int) (int, bool, error) {
+	prefix := sysKey("expiry")
+	entries, keys, err := db.readBatch(GTE, prefix, prefix, batch)
+	if nil != err {
+		return 0, false, err
+	}
+	now := time.Now().UnixNano()
+	swept, more := 0, len(entries) == batch
+	err = db.update(func() error {
+		for i, entry := range entries {
+			t, _, err := decodeKeyPart(entry[len(prefix):])
+			if nil != err {
+				return err
+			}
+			if t.(int64) > now {
+				more = false
+				return nil
+			}
+			// The entry is stale if the key has since been rewritten
+			// with another expiry time, or deleted.
+			stored, err := db.get(keys[i])
+			if nil == err {
+				if expires, _ := db.splitExpiry(stored); expires == t.(int64) {
+					if err = db.remove(keys[i]); nil != err {
+						return err
+					}
+					swept++
+				}
+			} else if ErrNotFound != err {
+				return err
+			}
+			if err = db.delete(entry); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return 0, false, err
+	}
+	return swept, more, nil
+}
+
+// SweeperConfig configures the background sweeper started by
+// StartSweeper.
+type SweeperConfig struct {
+	// Interval is the time between sweeps. The default is one minute.
+	Interval time.Duration
+	// BatchSize is the maximum number of keys deleted in each
+	// transaction. The default is 100.
+	BatchSize int
+	// OnError, if not nil, is called with any error from a sweep.
+	OnError func(error)
+}
+
+// sweeper is a running background goroutine, such as the sweeper.
+type sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startBackground starts a goroutine that, every interval, calls step
+// until it returns false. Each call holds the database lock, and the
+// calls are skipped while a transaction is in progress or a Cursor is
+// open. Any error from step is passed to onError, if it is not nil.
+func (db *Database) startBackground(interval time.Duration, onError func(error), step func() (bool, error)) *sweeper {
+	s := &sweeper{make(chan struct{}), make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			for more := true; more; {
+				var err error
+				db.lock.Lock()
+				if db.tx || 0 < db.cursors {
+					more = false
+				} else {
+					more, err = step()
+				}
+				db.lock.Unlock()
+				if nil != err && nil != onError {
+					onError(err)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// stopBackground clears the goroutine held in s, and stops it, if one is
+// running, waiting for it to finish.
+func (db *Database) stopBackground(s **sweeper) {
+	db.lock.Lock()
+	running := *s
+	*s = nil
+	db.lock.Unlock()
+	if nil != running {
+		close(running.stop)
+		<-running.done
+	}
+}
+
+// StartSweeper starts a goroutine that periodically deletes expired
+// keys, replacing any sweeper already running. Each batch is deleted in
+// its own short transaction. A sweep is skipped while a transaction is in
+// progress or a Cursor is open.
+//
+// The sweeper is stopped by StopSweeper or Close.
+func (db *Database) StartSweeper(config SweeperConfig) {
+	db.StopSweeper()
+	if 0 >= config.Interval {
+		config.Interval = time.Minute
+	}
+	if 0 >= config.BatchSize {
+		config.BatchSize = 100
+	}
+	s := db.startBackground(config.Interval, config.OnError, func() (bool, error) {
+		_, more, err := db.sweepBatch(config.BatchSize)
+		return more, err
+	})
+	db.lock.Lock()
+	db.sweeper = s
+	db.lock.Unlock()
+}
+
+// StopSweeper stops the background sweeper, if one is running, and waits
+// for it to finish.
+func (db *Database) StopSweeper() {
+	db.stopBackground(&db.sweeper)
+}
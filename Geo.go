@@ -0,0 +1,303 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// ErrInvalidCoordinates is returned for a latitude outside [-90, 90] or a
+// longitude outside [-180, 180].
+var ErrInvalidCoordinates = errors.New("Invalid coordinates")
+
+// geoBits is the number of bits of each of the latitude and the
+// longitude in a geohash.
+const geoBits = 26
+
+// maxGeoCells is the greatest number of geohash cells a bounding box is
+// decomposed into.
+const maxGeoCells = 32
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// GeoIndex is an index of points stored in a Database. Points are keyed
+// by geohash, interleaving the bits of the latitude and longitude, so
+// that nearby points usually have nearby keys and any geohash cell is a
+// contiguous range of keys.
+type GeoIndex struct {
+	db   *Database
+	name string
+}
+
+// GeoPoint is a point in a GeoIndex.
+type GeoPoint struct {
+	ID       []byte
+	Lat, Lon float64
+	// Distance is the distance in meters from the center of a radius
+	// query.
+	Distance float64
+}
+
+// GeoIndex returns the named GeoIndex.
+func (db *Database) GeoIndex(name string) *GeoIndex {
+	return &GeoIndex{db: db, name: name}
+}
+
+// geoKey returns the key of the point with the geohash.
+func (g *GeoIndex) geoKey(hash uint64, id []byte) []byte {
+	return sysKey("geo", g.name, "hash", hash, id)
+}
+
+// positionKey returns the key holding the position of the point.
+func (g *GeoIndex) positionKey(id []byte) []byte {
+	return sysKey("geo", g.name, "id", id)
+}
+
+// quantize returns the cell of the coordinate in [min, max] among
+// 2^geoBits cells.
+func quantize(v, min, max float64) uint64 {
+	cell := uint64((v - min) / (max - min) * (1 << geoBits))
+	if cell >= 1<<geoBits {
+		cell = 1<<geoBits - 1
+	}
+	return cell
+}
+
+// interleave interleaves the bits of the longitude and latitude cells,
+// starting with the most significant bit of the longitude.
+func interleave(lon, lat uint64, bits uint) uint64 {
+	var hash uint64
+	for i := int(bits) - 1; 0 <= i; i-- {
+		hash = hash<<2 | (lon>>uint(i)&1)<<1 | lat>>uint(i)&1
+	}
+	return hash
+}
+
+// Geohash returns the geohash of the coordinates, as an integer of 52
+// bits.
+func Geohash(lat, lon float64) uint64 {
+	return interleave(quantize(lon, -180, 180), quantize(lat, -90, 90), geoBits)
+}
+
+func validCoordinates(lat, lon float64) bool {
+	return -90 <= lat && lat <= 90 && -180 <= lon && lon <= 180
+}
+
+func encodePosition(lat, lon float64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(lat))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(lon))
+	return buf
+}
+
+func decodePosition(buf []byte) (float64, float64, error) {
+	if 16 != len(buf) {
+		return 0, 0, errors.New("Invalid geo position")
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), math.Float64frombits(binary.BigEndian.Uint64(buf[8:])), nil
+}
+
+// Add adds the point with the id to the index, moving it if it is
+// already in the index.
+func (g *GeoIndex) Add(id []byte, lat, lon float64) error {
+	if !validCoordinates(lat, lon) {
+		return ErrInvalidCoordinates
+	}
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	return g.db.update(func() error {
+		if err := g.remove(id); nil != err && ErrNotFound != err {
+			return err
+		}
+		pos := encodePosition(lat, lon)
+		if err := g.db.set(g.geoKey(Geohash(lat, lon), id), pos); nil != err {
+			return err
+		}
+		return g.db.set(g.positionKey(id), pos)
+	})
+}
+
+// Remove removes the point with the id from the index.
+func (g *GeoIndex) Remove(id []byte) error {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	return g.db.update(func() error {
+		return g.remove(id)
+	})
+}
+
+func (g *GeoIndex) remove(id []byte) error {
+	buf, err := g.db.get(g.positionKey(id))
+	if nil != err {
+		return err
+	}
+	lat, lon, err := decodePosition(buf)
+	if nil != err {
+		return err
+	}
+	if err = g.db.delete(g.geoKey(Geohash(lat, lon), id)); nil != err {
+		return err
+	}
+	return g.db.delete(g.positionKey(id))
+}
+
+// Position returns the coordinates of the point with the id.
+func (g *GeoIndex) Position(id []byte) (float64, float64, error) {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	buf, err := g.db.get(g.positionKey(id))
+	if nil != err {
+		return 0, 0, err
+	}
+	return decodePosition(buf)
+}
+
+// hashRange is a range of geohashes, from start (inclusive) to end
+// (exclusive).
+type hashRange struct {
+	start, end uint64
+}
+
+// boxRanges decomposes the bounding box into the geohash ranges of the
+// cells covering it, at the finest level with at most maxGeoCells cells.
+// The longitudes must not cross the antimeridian.
+func boxRanges(minLat, minLon, maxLat, maxLon float64) []hashRange {
+	lat0, lat1 := quantize(minLat, -90, 90), quantize(maxLat, -90, 90)
+	lon0, lon1 := quantize(minLon, -180, 180), quantize(maxLon, -180, 180)
+	level := uint(geoBits)
+	for 0 < level && (lat1-lat0+1)*(lon1-lon0+1) > maxGeoCells {
+		level--
+		lat0, lat1, lon0, lon1 = lat0>>1, lat1>>1, lon0>>1, lon1>>1
+	}
+	shift := 2 * (geoBits - level)
+	var ranges []hashRange
+	for lat := lat0; lat <= lat1; lat++ {
+		for lon := lon0; lon <= lon1; lon++ {
+			start := interleave(lon, lat, level) << shift
+			ranges = append(ranges, hashRange{start, start + 1<<shift})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		if last := &merged[len(merged)-1]; r.start == last.end {
+			last.end = r.end
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// scanRange calls fn with each point in the geohash range.
+//
+// The database lock must be held.
+func (g *GeoIndex) scanRange(r hashRange, fn func(p GeoPoint) error) error {
+	prefix := sysKey("geo", g.name, "hash")
+	return g.db.scanRaw(sysKey("geo", g.name, "hash", r.start), prefix, 1000, func(key, value []byte) error {
+		hash, rest, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		if hash.(uint64) >= r.end {
+			return errStopScan
+		}
+		id, _, err := decodeKeyPart(rest)
+		if nil != err {
+			return err
+		}
+		lat, lon, err := decodePosition(value)
+		if nil != err {
+			return err
+		}
+		return fn(GeoPoint{ID: id.([]byte), Lat: lat, Lon: lon})
+	})
+}
+
+// WithinBox returns the points inside the bounding box. If minLon is
+// greater than maxLon, the box crosses the antimeridian.
+func (g *GeoIndex) WithinBox(minLat, minLon, maxLat, maxLon float64) ([]GeoPoint, error) {
+	if !validCoordinates(minLat, minLon) || !validCoordinates(maxLat, maxLon) || minLat > maxLat {
+		return nil, ErrInvalidCoordinates
+	}
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	return g.withinBox(minLat, minLon, maxLat, maxLon, func(GeoPoint) bool { return true })
+}
+
+// withinBox returns the points inside the bounding box for which keep
+// returns true.
+//
+// The database lock must be held.
+func (g *GeoIndex) withinBox(minLat, minLon, maxLat, maxLon float64, keep func(GeoPoint) bool) ([]GeoPoint, error) {
+	boxes := [][4]float64{{minLat, minLon, maxLat, maxLon}}
+	if minLon > maxLon {
+		boxes = [][4]float64{{minLat, minLon, maxLat, 180}, {minLat, -180, maxLat, maxLon}}
+	}
+	var points []GeoPoint
+	for _, b := range boxes {
+		for _, r := range boxRanges(b[0], b[1], b[2], b[3]) {
+			err := g.scanRange(r, func(p GeoPoint) error {
+				// The cells cover more than the box.
+				if b[0] <= p.Lat && p.Lat <= b[2] && b[1] <= p.Lon && p.Lon <= b[3] && keep(p) {
+					points = append(points, p)
+				}
+				return nil
+			})
+			if nil != err {
+				return nil, err
+			}
+		}
+	}
+	return points, nil
+}
+
+// Distance returns the great-circle distance in meters between two
+// points, using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// WithinRadius returns the points within the distance in meters of the
+// center, nearest first. The points in the bounding box of the circle are
+// scanned, and filtered by their exact distance.
+func (g *GeoIndex) WithinRadius(lat, lon, meters float64) ([]GeoPoint, error) {
+	if !validCoordinates(lat, lon) || 0 > meters {
+		return nil, ErrInvalidCoordinates
+	}
+	dLat := meters / earthRadius * 180 / math.Pi
+	minLat, maxLat := math.Max(-90, lat-dLat), math.Min(90, lat+dLat)
+	minLon, maxLon := -180.0, 180.0
+	// Near the poles the circle may span every longitude.
+	if cos := math.Cos(math.Max(math.Abs(minLat), math.Abs(maxLat)) * math.Pi / 180); 90 > maxLat && -90 < minLat && dLat < 90*cos {
+		dLon := dLat / cos
+		if minLon = lon - dLon; -180 > minLon {
+			minLon += 360
+		}
+		if maxLon = lon + dLon; 180 < maxLon {
+			maxLon -= 360
+		}
+	}
+	g.db.lock.Lock()
+	points, err := g.withinBox(minLat, minLon, maxLat, maxLon, func(p GeoPoint) bool {
+		return Distance(lat, lon, p.Lat, p.Lon) <= meters
+	})
+	g.db.lock.Unlock()
+	if nil != err {
+		return nil, err
+	}
+	for i := range points {
+		points[i].Distance = Distance(lat, lon, points[i].Lat, points[i].Lon)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Distance < points[j].Distance
+	})
+	return points, nil
+}
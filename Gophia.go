@@ -2,6 +2,7 @@ package gophia
 
 import (
 	"errors"
+	"runtime/cgo"
 	"unsafe"
 )
 
@@ -10,7 +11,8 @@ import (
 #include <sophia.h>
 
 extern int sp_ctl_dir(void *p, uint32_t access, char *dir);
-extern int sp_ctl_cmp(void *p, void *cmp);
+extern int sp_ctl_cmp(void *p, uintptr_t h);
+extern int sp_ctl_cmp_native(void *p, int which);
 extern int sp_ctl_page(void *p, uint32_t count);
 extern int sp_ctl_gc(void *p, int active);
 extern int sp_ctl_gcf(void *p, double factor);
@@ -22,11 +24,18 @@ extern int sp_ctl_mergewm(void *p, uint32_t watermark);
 import "C"
 
 //export go_sp_comparator
-func go_sp_comparator(aptr unsafe.Pointer, asz C.size_t, bptr unsafe.Pointer, bsz C.size_t, arg unsafe.Pointer) C.int {
-	a := C.GoBytes(aptr, C.int(asz))
-	b := C.GoBytes(bptr, C.int(bsz))
-	cmp := (*Comparator)(arg)
-	return C.int((*cmp)(a, b))
+func go_sp_comparator(a *C.char, asz C.size_t, b *C.char, bsz C.size_t, h C.uintptr_t) C.int {
+	cmp := cgo.Handle(h).Value().(KeyComparator)
+	return C.int(cmp.Compare(cBytesView(a, asz), cBytesView(b, bsz)))
+}
+
+// cBytesView returns a slice over C memory without copying it. The
+// slice is only valid for as long as the C memory is.
+func cBytesView(p *C.char, size C.size_t) []byte {
+	if 0 == size {
+		return []byte{}
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), int(size))
 }
 
 // sp_close closes the pointer and sets it to nil
@@ -1,8 +1,16 @@
 package gophia
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBasicSanity(t *testing.T) {
@@ -129,33 +137,33 @@ func TestIterator(t *testing.T) {
 
 func TestTransactions(t *testing.T) {
 	checkErr := func(err error) {
-		if nil!=err {
+		if nil != err {
 			t.Fatal(err)
 		}
 	}
 	db, err := Open(Create, "testdb_trans")
 	defer db.Close()
-	values := [][2]string {
-		[2]string { "one", "ichi"},
-		[2]string{ "two", "nichi" },
-		[2]string{ "three", "san" },
+	values := [][2]string{
+		[2]string{"one", "ichi"},
+		[2]string{"two", "nichi"},
+		[2]string{"three", "san"},
 	}
 	for _, v := range values {
 		checkErr(db.DeleteS(v[0]))
 	}
 	enterValues := func() error {
-		for _,v := range values {
-			checkErr(db.SetSS(v[0],v[1]))
+		for _, v := range values {
+			checkErr(db.SetSS(v[0], v[1]))
 		}
 		return nil
 	}
 	checkValues := func() (bool, error) {
-		for _,v := range values {
+		for _, v := range values {
 			val, err := db.GetSS(v[0])
-			if nil!=err {				
+			if nil != err {
 				return false, err
 			}
-			if v[1]!=val {
+			if v[1] != val {
 				return false, fmt.Errorf("Value of %v didn't match: %v", v[0], val)
 			}
 		}
@@ -171,7 +179,7 @@ func TestTransactions(t *testing.T) {
 	checkErr(enterValues())
 	checkErr(db.Rollback())
 	f, err := checkValues()
-	if f || ErrNotFound!=err {
+	if f || ErrNotFound != err {
 		t.Errorf("Inserted values in place despite transaction rollback")
 	}
 
@@ -179,8 +187,2001 @@ func TestTransactions(t *testing.T) {
 	checkErr(enterValues())
 	checkErr(db.Commit())
 	f, err = checkValues()
-	if nil!=err || !f {
+	if nil != err || !f {
 		t.Errorf("Values not in place but transaction committed")
 	}
 
-}
\ No newline at end of file
+}
+func TestComparators(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, cmp := range []KeyComparator{
+		ReverseBytesComparator,
+		Comparator(func(a, b []byte) int { return bytes.Compare(b, a) }),
+	} {
+		env, err := NewEnvironment()
+		checkErr(err)
+		checkErr(env.Dir(Create|ReadWrite, "testdb_cmp"))
+		checkErr(env.CmpKeys(cmp))
+		db, err := env.Open()
+		checkErr(err)
+		for _, k := range keys {
+			checkErr(db.SetSS(k, k))
+		}
+		var got []string
+		checkErr(db.Each(GTE, nil, func(key, value []byte) {
+			got = append(got, string(key))
+		}))
+		checkErr(db.Close())
+		checkErr(env.Close())
+		if len(got) != len(keys) {
+			t.Fatalf("Expected %d keys, got %v", len(keys), got)
+		}
+		for i, k := range got {
+			if k != keys[len(keys)-1-i] {
+				t.Errorf("Keys not in reverse order: %v", got)
+				break
+			}
+		}
+	}
+
+	// Range scans read keys bytewise in reverse ordered databases, and are
+	// rejected in databases with a custom key order.
+	for _, cmp := range []KeyComparator{
+		ReverseBytesComparator,
+		Comparator(func(a, b []byte) int { return bytes.Compare(b, a) }),
+	} {
+		env, err := NewEnvironment()
+		checkErr(err)
+		checkErr(env.Dir(Create|ReadWrite, "testdb_cmp_scan"))
+		checkErr(env.CmpKeys(cmp))
+		db, err := env.Open()
+		checkErr(err)
+		if _, ok := cmp.(NativeComparator); ok {
+			db.AddIndex("value", func(key, value []byte) [][]byte {
+				return [][]byte{value}
+			})
+			for _, k := range []string{"e", "f"} {
+				checkErr(db.SetSS(k, "indexed"))
+			}
+			checkErr(db.SetWithTTL([]byte("g"), []byte("expired"), -time.Second))
+			found, err := db.LookupByIndex("value", []byte("indexed"))
+			checkErr(err)
+			if !reflect.DeepEqual([][]byte{[]byte("e"), []byte("f")}, found) {
+				t.Errorf("LookupByIndex returned %q", found)
+			}
+			if n, err := db.Sweep(10); 1 != n {
+				t.Errorf("Sweep deleted %d keys (%v), expected 1", n, err)
+			}
+			bucket, err := db.Bucket("cmp")
+			checkErr(err)
+			for _, k := range keys {
+				checkErr(bucket.Set([]byte(k), []byte(k)))
+			}
+			for order, expected := range map[Order]string{GTE: "dcba", LTE: "abcd"} {
+				got := ""
+				checkErr(bucket.Each(order, nil, func(key, value []byte) {
+					got += string(key)
+				}))
+				if expected != got {
+					t.Errorf("Bucket.Each(%v) returned %q, expected %q", order, got, expected)
+				}
+			}
+			people, err := db.Collection("cmp_people")
+			checkErr(err)
+			checkErr(people.Put([]byte("1"), map[string]int{"age": 31}))
+			if docs, err := people.Find(Predicate{"age", ">", 30}); 1 != len(docs) {
+				t.Errorf("Find returned %d documents (%v), expected 1", len(docs), err)
+			}
+			checkErr(db.DeleteBucket("cmp"))
+			checkErr(db.DeleteBucket("cmp_people"))
+		} else {
+			db.AddIndex("value", func(key, value []byte) [][]byte {
+				return [][]byte{value}
+			})
+			if _, err := db.LookupByIndex("value", []byte("indexed")); ErrKeyOrder != err {
+				t.Errorf("Expected ErrKeyOrder from LookupByIndex, got %v", err)
+			}
+			if _, err := db.Sweep(10); ErrKeyOrder != err {
+				t.Errorf("Expected ErrKeyOrder from Sweep, got %v", err)
+			}
+			if err := db.DeferMerges(true); ErrKeyOrder != err {
+				t.Errorf("Expected ErrKeyOrder from DeferMerges, got %v", err)
+			}
+			bucket, err := db.Bucket("cmp")
+			checkErr(err)
+			if _, err := bucket.Cursor(GTE, nil); ErrKeyOrder != err {
+				t.Errorf("Expected ErrKeyOrder from Bucket.Cursor, got %v", err)
+			}
+		}
+		checkErr(db.Close())
+		checkErr(env.Close())
+	}
+
+	// The numeric comparators order keys of the wrong length by length,
+	// which keeps the ordering transitive.
+	a := []byte{2, 0, 0, 0, 0, 0, 0, 0}
+	b := []byte{1, 0, 0, 0, 0, 0, 0, 1}
+	c := []byte{1, 5}
+	for _, cmp := range []NativeComparator{Uint32Comparator, Uint64Comparator, Int64Comparator} {
+		if 0 <= cmp.Compare(c, a) || 0 <= cmp.Compare(c, b) || cmp.Compare(a, b) != -cmp.Compare(b, a) {
+			t.Errorf("Comparator %d does not order %v, %v and %v totally", cmp, a, b, c)
+		}
+	}
+	u32 := func(n uint32) string {
+		return string(binary.NativeEndian.AppendUint32(nil, n))
+	}
+	u64 := func(n uint64) string {
+		return string(binary.NativeEndian.AppendUint64(nil, n))
+	}
+	for cmp, ordered := range map[NativeComparator][]string{
+		Uint32Comparator: {"z", "\x00\xff", u32(1), u32(256), u32(1 << 31), "\x00\x00\x00\x00\x00"},
+		Uint64Comparator: {"\xff", u32(7), u64(1), u64(256), u64(1 << 63)},
+		Int64Comparator:  {"\xff", u32(7), u64(1 << 63), u64(^uint64(0)), u64(0), u64(300)},
+	} {
+		env, err := NewEnvironment()
+		checkErr(err)
+		checkErr(env.Dir(Create|ReadWrite, fmt.Sprintf("testdb_cmp%d", cmp)))
+		checkErr(env.CmpKeys(cmp))
+		db, err := env.Open()
+		checkErr(err)
+		for i := len(ordered) - 1; i >= 0; i-- {
+			checkErr(db.SetSS(ordered[i], "x"))
+		}
+		var got []string
+		checkErr(db.Each(GTE, nil, func(key, value []byte) {
+			got = append(got, string(key))
+		}))
+		checkErr(db.Close())
+		checkErr(env.Close())
+		if !reflect.DeepEqual(ordered, got) {
+			t.Errorf("Comparator %d ordered keys %q, expected %q", cmp, got, ordered)
+		}
+		for i := 1; i < len(ordered); i++ {
+			if 0 <= cmp.Compare([]byte(ordered[i-1]), []byte(ordered[i])) {
+				t.Errorf("Comparator %d does not order %q before %q in Go", cmp, ordered[i-1], ordered[i])
+			}
+		}
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	ordered := [][]interface{}{
+		{"a", int64(-5)},
+		{"a", int64(-1)},
+		{"a", int64(0)},
+		{"a", int64(7), 1.5},
+		{"a\x00b", int64(1)},
+		{"ab", int64(1)},
+		{"b", -2.5},
+		{"b", 0.0},
+		{"b", 3.25},
+	}
+	var prev []byte
+	for _, parts := range ordered {
+		key := MustEncodeKey(parts...)
+		if nil != prev && 0 <= bytes.Compare(prev, key) {
+			t.Errorf("Key for %v does not sort after previous key", parts)
+		}
+		prev = key
+		decoded, err := DecodeKey(key)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parts, decoded) {
+			t.Errorf("Decoded %v, expected %v", decoded, parts)
+		}
+	}
+}
+
+type account struct {
+	Bank   string `gophia:"key"`
+	Number int    `gophia:"key"`
+	Owner  string
+}
+
+func TestMapping(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_mapping")
+	checkErr(err)
+	defer db.Close()
+
+	checkErr(db.Put(&account{"first", 12, "Craig"}))
+	checkErr(db.Put(account{"first", 13, "Fred"}))
+
+	a := account{Bank: "first", Number: 12}
+	checkErr(db.Load(&a))
+	if "Craig" != a.Owner {
+		t.Errorf("Loaded wrong account: %v", a)
+	}
+	checkErr(db.Remove(a))
+	if err := db.Load(&a); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound loading removed account, got %v", err)
+	}
+	b := account{Bank: "first", Number: 13}
+	checkErr(db.Load(&b))
+	if "Fred" != b.Owner {
+		t.Errorf("Loaded wrong account: %v", b)
+	}
+	if _, err := KeyOf(person{}); ErrNoKeyFields != err {
+		t.Errorf("Expected ErrNoKeyFields, got %v", err)
+	}
+
+	type userID int64
+	type user struct {
+		ID userID `gophia:"key"`
+	}
+	key, err := KeyOf(user{42})
+	checkErr(err)
+	if parts, _ := DecodeKey(key); !reflect.DeepEqual([]interface{}{reflect.TypeOf(user{}).PkgPath() + ".user", int64(42)}, parts) {
+		t.Errorf("Unexpected key parts %v", parts)
+	}
+	if _, err := KeyOf(struct {
+		ID int `gophia:"key"`
+	}{1}); ErrUnnamedStruct != err {
+		t.Errorf("Expected ErrUnnamedStruct, got %v", err)
+	}
+	type secret struct {
+		id int `gophia:"key"`
+	}
+	if _, err := KeyOf(secret{1}); nil == err {
+		t.Errorf("Expected an error for an unexported key field")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_compress")
+	checkErr(err)
+	defer db.Close()
+
+	legacy := "{\"legacy\":true}"
+	checkErr(db.SetSS("legacy", legacy))
+	checkErr(db.SetSS("pounds", "£5"))
+	checkErr(db.Compress(GzipCompressor, 64))
+
+	long := strings.Repeat("gophia compresses well ", 100)
+	checkErr(db.SetSS("long", long))
+	checkErr(db.SetSS("short", "\xc1 looks like a marker"))
+	raw, err := db.get([]byte("long"))
+	checkErr(err)
+	if len(raw) >= len(long) {
+		t.Errorf("Long value was not compressed: %d bytes", len(raw))
+	}
+	for k, v := range map[string]string{"legacy": legacy, "pounds": "£5", "long": long, "short": "\xc1 looks like a marker"} {
+		got, err := db.GetSS(k)
+		checkErr(err)
+		if v != got {
+			t.Errorf("Value for %s not restored: %q", k, got)
+		}
+	}
+	cur, err := db.CursorS(GTE, "long")
+	checkErr(err)
+	defer cur.Close()
+	if !cur.Fetch() || long != cur.ValueS() {
+		t.Errorf("Cursor did not decompress value")
+	}
+	checkErr(cur.Err())
+}
+
+func TestEncryption(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_encrypt")
+	checkErr(err)
+	defer db.Close()
+
+	checkErr(db.SetSS("plain", "plaintext value"))
+	checkErr(db.SetSS("accented", "ä plaintext value"))
+
+	// The values gophia stores for its own use are encrypted too.
+	q, err := db.Queue("encrypted")
+	checkErr(err)
+	for {
+		if _, err := q.Pop(); ErrQueueEmpty == err {
+			break
+		}
+		checkErr(err)
+	}
+	db.DeleteBlob([]byte("blob"))
+	g := db.Graph("encrypted")
+	g.DeleteNode([]byte("a"))
+	h := db.Hash("encrypted")
+	l := db.List("encrypted")
+	for {
+		if _, err := l.PopFront(); nil != err {
+			break
+		}
+	}
+	checkErr(db.MergeOperator([]byte("log"), "append"))
+	db.DeleteS("log")
+	db.DeleteS("buried")
+
+	ring := NewKeyring()
+	ring.Plaintext = true
+	checkErr(ring.AddKey(1, bytes.Repeat([]byte{1}, 32)))
+	db.Encrypt(ring)
+	checkErr(db.SetSS("secret", "regulated data"))
+
+	for _, s := range []string{"leased", "ready"} {
+		_, err = q.Push([]byte(s))
+		checkErr(err)
+	}
+	// The lease has already expired, so the message is requeued when the
+	// Queue is next read.
+	_, err = q.Reserve(-time.Second)
+	checkErr(err)
+	w := db.CreateBlob([]byte("blob"), 4)
+	_, err = w.Write([]byte("chunked blob"))
+	checkErr(err)
+	checkErr(w.Close())
+	series := db.Series("encrypted", nil)
+	checkErr(series.Add(time.Unix(0, 0), 1.5))
+	checkErr(g.SetNode([]byte("a"), []byte("node")))
+	checkErr(g.AddEdge([]byte("a"), "to", []byte("b"), []byte("edge")))
+	checkErr(h.Set([]byte("field"), []byte("hash value")))
+	_, err = l.PushBack([]byte("element"))
+	checkErr(err)
+	checkErr(db.DeferMerges(true))
+	checkErr(db.Merge([]byte("log"), []byte("deferred")))
+	checkErr(db.DeferMerges(false))
+	// Gophia's own keys are found as they are stored, without the
+	// deferred merges or the Keyring.
+	checkErr(h.Set([]byte("field"), []byte("hash value")))
+	members := db.MemberSet("encrypted")
+	_, err = members.Add([]byte("member"))
+	checkErr(err)
+	if ok, err := members.Has([]byte("member")); !ok || nil != err {
+		t.Errorf("MemberSet.Has returned %v (%v)", ok, err)
+	}
+	db.Versioning(&VersionPolicy{MaxVersions: 1})
+	checkErr(db.SetSS("versioned", "history"))
+	db.Versioning(nil)
+	checkErr(db.SetSS("buried", "tombstone"))
+	db.SoftDeletes(true)
+	checkErr(db.DeleteS("buried"))
+	db.SoftDeletes(false)
+
+	raw, err := db.get([]byte("secret"))
+	checkErr(err)
+	if bytes.Contains(raw, []byte("regulated")) {
+		t.Errorf("Value stored in plaintext")
+	}
+
+	// Rotate to a new key, and drop the old one.
+	checkErr(ring.AddKey(2, bytes.Repeat([]byte{2}, 32)))
+	checkErr(ring.SetPrimary(2))
+	// System entries of an unexpected shape are left as they are.
+	odd := [][]byte{sysKey("tombstone", "odd", int64(1)), sysKey("version", "odd", int64(1))}
+	for _, k := range odd {
+		checkErr(db.set(k, []byte{versionValue, 'x'}))
+	}
+	n, err := db.Reencrypt()
+	checkErr(err)
+	if n < 2 {
+		t.Errorf("Reencrypt rewrote %d values, expected at least 2", n)
+	}
+	for _, k := range odd {
+		if v, err := db.get(k); "\x01x" != string(v) {
+			t.Errorf("Reencrypt rewrote %q as %q (%v)", k, v, err)
+		}
+		checkErr(db.delete(k))
+	}
+	ring.RemoveKey(1)
+	ring.Plaintext = false
+
+	checkErr(db.Begin())
+	checkErr(db.SetSS("tx", "in a transaction"))
+	checkErr(db.Commit())
+	for k, v := range map[string]string{"plain": "plaintext value", "accented": "ä plaintext value", "secret": "regulated data", "tx": "in a transaction"} {
+		got, err := db.GetSS(k)
+		checkErr(err)
+		if v != got {
+			t.Errorf("Value for %s not decrypted: %q", k, got)
+		}
+	}
+	checkErr(db.Each(GTE, nil, func(key, value []byte) {
+		if 0 == len(value) {
+			t.Errorf("Cursor failed to decrypt %s", key)
+		}
+	}))
+
+	for _, s := range []string{"leased", "ready"} {
+		if v, err := q.Pop(); s != string(v) {
+			t.Errorf("Queue returned %q (%v), expected %s", v, err, s)
+		}
+	}
+	r, err := db.OpenBlob([]byte("blob"))
+	checkErr(err)
+	if v, err := io.ReadAll(r); "chunked blob" != string(v) {
+		t.Errorf("Blob read as %q (%v)", v, err)
+	}
+	checkErr(series.Range(time.Unix(0, 0), time.Unix(1, 0), func(_ time.Time, v float64) error {
+		if 1.5 != v {
+			t.Errorf("Series point read as %v", v)
+		}
+		return nil
+	}))
+	if v, err := g.Node([]byte("a")); "node" != string(v) {
+		t.Errorf("Graph node read as %q (%v)", v, err)
+	}
+	if v, err := g.EdgeValue([]byte("a"), "to", []byte("b")); "edge" != string(v) {
+		t.Errorf("Graph edge read as %q (%v)", v, err)
+	}
+	if v, err := h.Get([]byte("field")); "hash value" != string(v) {
+		t.Errorf("Hash field read as %q (%v)", v, err)
+	}
+	if v, err := l.Index(0); "element" != string(v) {
+		t.Errorf("List element read as %q (%v)", v, err)
+	}
+	if v, err := db.GetSS("log"); "deferred" != v {
+		t.Errorf("Deferred merge read as %q (%v)", v, err)
+	}
+	if v, err := db.GetAsOf([]byte("versioned"), time.Now()); "history" != string(v) {
+		t.Errorf("Version read as %q (%v)", v, err)
+	}
+	checkErr(db.Undelete([]byte("buried")))
+	if v, err := db.GetSS("buried"); "tombstone" != v {
+		t.Errorf("Undeleted value read as %q (%v)", v, err)
+	}
+}
+
+type personV1 struct {
+	Name string
+}
+
+func (personV1) SchemaVersion() (string, int) {
+	return "person", 1
+}
+
+type personV2 struct {
+	First, Last string
+}
+
+func (*personV2) SchemaVersion() (string, int) {
+	return "person", 2
+}
+
+func TestSchemaMigration(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_schema")
+	checkErr(err)
+	defer db.Close()
+
+	RegisterObjectMigration("person", 1, func(p personV1) (personV2, error) {
+		names := strings.SplitN(p.Name, " ", 2)
+		return personV2{names[0], names[1]}, nil
+	})
+	checkErr(db.SetSO("craig", personV1{"Craig Mason-Jones"}))
+	checkErr(db.SetSO("fred", personV1{"Fred Bloggs"}))
+
+	var p personV2
+	checkErr(db.GetSO("craig", &p))
+	if "Craig" != p.First || "Mason-Jones" != p.Last {
+		t.Errorf("Lazy migration failed: %v", p)
+	}
+
+	// Pretend an earlier run was interrupted after "craig".
+	checkErr(db.set(migrationCheckpoint, []byte("fred")))
+	var reports int
+	progress, err := db.MigrateObjects(func(MigrationProgress) { reports++ })
+	checkErr(err)
+	if 1 != progress.Scanned || 1 != progress.Migrated || 0 == reports {
+		t.Errorf("Expected to resume and migrate 1 value, got %v after %d reports", progress, reports)
+	}
+	raw, err := db.GetSA("fred")
+	checkErr(err)
+	if name, version, _, _ := parseSchemaHeader(raw); "person" != name || 2 != version {
+		t.Errorf("Value not migrated eagerly: %s v%d", name, version)
+	}
+	if has, _ := db.Has(migrationCheckpoint); has {
+		t.Errorf("Migration checkpoint not removed")
+	}
+	checkErr(db.GetSO("craig", &p))
+	checkErr(db.set(migrationCheckpoint, []byte("fred")))
+	var count int
+	checkErr(db.Each(GTE, nil, func(key, value []byte) { count++ }))
+	if 2 != count {
+		t.Errorf("Cursor returned %d rows, expected 2", count)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_index")
+	checkErr(err)
+	defer db.Close()
+
+	db.AddIndex("name", ObjectIndex(func(key []byte, p person) [][]byte {
+		return [][]byte{[]byte(p.Name)}
+	}))
+	checkErr(db.SetSO("1", person{1, "Craig"}))
+	checkErr(db.SetSO("2", person{2, "Fred"}))
+	checkErr(db.SetSO("3", person{3, "Craig"}))
+	checkErr(db.SetSO("2", person{2, "Anne"}))
+
+	keys, err := db.LookupByIndex("name", []byte("Craig"))
+	checkErr(err)
+	if 2 != len(keys) || "1" != string(keys[0]) || "3" != string(keys[1]) {
+		t.Errorf("Lookup returned wrong keys: %q", keys)
+	}
+	keys, err = db.LookupByIndex("name", []byte("Fred"))
+	checkErr(err)
+	if 0 != len(keys) {
+		t.Errorf("Stale index entry for Fred: %q", keys)
+	}
+
+	checkErr(db.Begin())
+	checkErr(db.DeleteS("1"))
+	checkErr(db.Rollback())
+	checkErr(db.DeleteS("3"))
+
+	var names []string
+	checkErr(db.ScanIndex("name", []byte("B"), nil, func(value, key []byte) error {
+		names = append(names, string(value)+"="+string(key))
+		return nil
+	}))
+	if 1 != len(names) || "Craig=1" != names[0] {
+		t.Errorf("Index scan returned %v", names)
+	}
+	checkErr(db.RebuildIndex("name"))
+	names = nil
+	checkErr(db.ScanIndex("name", nil, []byte("B"), func(value, key []byte) error {
+		names = append(names, string(value)+"="+string(key))
+		return nil
+	}))
+	if 1 != len(names) || "Anne=2" != names[0] {
+		t.Errorf("Index scan after rebuild returned %v", names)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_bucket")
+	checkErr(err)
+	defer db.Close()
+
+	users, err := db.Bucket("users")
+	checkErr(err)
+	admins, err := users.Bucket("admins")
+	checkErr(err)
+	orders, err := db.Bucket("orders")
+	checkErr(err)
+
+	checkErr(db.SetSS("1", "root"))
+	checkErr(users.Set([]byte("1"), []byte("craig")))
+	checkErr(users.Set([]byte("2"), []byte("fred")))
+	checkErr(admins.Set([]byte("1"), []byte("anne")))
+	checkErr(db.Begin())
+	checkErr(orders.Set([]byte("1"), []byte("rolled back")))
+	checkErr(db.Rollback())
+
+	v, err := users.Get([]byte("1"))
+	checkErr(err)
+	if "craig" != string(v) {
+		t.Errorf("Bucket returned wrong value %q", v)
+	}
+	if has, _ := orders.Has([]byte("1")); has {
+		t.Errorf("Bucket write not rolled back")
+	}
+	for _, order := range []Order{GTE, LTE} {
+		var rows []string
+		checkErr(users.Each(order, nil, func(key, value []byte) {
+			rows = append(rows, string(key)+"="+string(value))
+		}))
+		if 2 != len(rows) {
+			t.Errorf("Bucket cursor returned %v", rows)
+		}
+	}
+	var rows []string
+	checkErr(db.Each(GTE, nil, func(key, value []byte) {
+		rows = append(rows, string(key))
+	}))
+	if 1 != len(rows) || "1" != rows[0] {
+		t.Errorf("Database cursor returned bucket rows: %q", rows)
+	}
+
+	names, err := db.Buckets()
+	checkErr(err)
+	if !reflect.DeepEqual([]string{"orders", "users"}, names) {
+		t.Errorf("Buckets returned %v", names)
+	}
+	checkErr(db.DeleteBucket("users"))
+	if has, _ := admins.Has([]byte("1")); has {
+		t.Errorf("Nested bucket not deleted")
+	}
+	if names, _ = users.Buckets(); 0 != len(names) {
+		t.Errorf("Nested bucket still registered: %v", names)
+	}
+	if names, _ = db.Buckets(); !reflect.DeepEqual([]string{"orders"}, names) {
+		t.Errorf("Buckets after delete returned %v", names)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_expiry")
+	checkErr(err)
+	defer db.Close()
+
+	checkErr(db.SetWithTTL([]byte("session"), []byte("short"), time.Hour))
+	checkErr(db.SetWithTTL([]byte("cache"), []byte("long"), time.Hour))
+	checkErr(db.SetSS("plain", "\xf8 looks like a marker"))
+	checkErr(db.Expire([]byte("plain"), time.Hour))
+	checkErr(db.Persist([]byte("plain")))
+	if ttl, _ := db.TTL([]byte("cache")); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Unexpected TTL %v", ttl)
+	}
+	if !db.MustHasS("session") {
+		t.Errorf("Key expired early")
+	}
+	checkErr(db.Expire([]byte("session"), -time.Second))
+
+	if _, err := db.GetSS("session"); ErrNotFound != err {
+		t.Errorf("Expected expired key to be absent, got %v", err)
+	}
+	if db.MustHasS("session") {
+		t.Errorf("Has returned true for expired key")
+	}
+	var keys []string
+	checkErr(db.Each(GTE, nil, func(key, value []byte) {
+		keys = append(keys, string(key))
+	}))
+	if !reflect.DeepEqual([]string{"cache", "plain"}, keys) {
+		t.Errorf("Cursor returned %v", keys)
+	}
+	if v, _ := db.GetSS("plain"); "\xf8 looks like a marker" != v {
+		t.Errorf("Persisted value read as %q", v)
+	}
+
+	checkErr(db.SetWithTTL([]byte("sweepme"), []byte("x"), -time.Second))
+	db.StartSweeper(SweeperConfig{})
+	db.StopSweeper()
+	// Run the sweeper's steps in the background until they are done.
+	swept := make(chan bool)
+	s := db.startBackground(time.Millisecond, func(err error) { t.Error(err) }, func() (bool, error) {
+		_, more, err := db.sweepBatch(1)
+		if !more {
+			select {
+			case swept <- true:
+			default:
+			}
+		}
+		return more, err
+	})
+	<-swept
+	db.stopBackground(&s)
+	for _, k := range []string{"session", "sweepme"} {
+		if _, err := db.get([]byte(k)); ErrNotFound != err {
+			t.Errorf("Sweeper did not delete %s: %v", k, err)
+		}
+	}
+	n, err := db.Sweep(10)
+	checkErr(err)
+	if 0 != n || !db.MustHasS("cache") {
+		t.Errorf("Sweep deleted %d unexpired keys", n)
+	}
+	if _, err = db.Sweep(0); ErrBatchSize != err {
+		t.Errorf("Expected ErrBatchSize, got %v", err)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_counter")
+	checkErr(err)
+	defer db.Close()
+	for _, k := range []string{"hits", "misses", "ratio", "text"} {
+		checkErr(db.DeleteS(k))
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				if _, err := db.Increment([]byte("hits"), 1); nil != err {
+					t.Error(err)
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	n, err := db.Decrement([]byte("hits"), 50)
+	checkErr(err)
+	if 350 != n {
+		t.Errorf("Expected counter 350, got %d", n)
+	}
+	f, err := db.IncrementFloat([]byte("ratio"), 0.25)
+	checkErr(err)
+	if f, err = db.IncrementFloat([]byte("ratio"), 0.5); 0.75 != f {
+		t.Errorf("Expected float counter 0.75, got %v (%v)", f, err)
+	}
+
+	checkErr(db.SetSS("text", "not a counter"))
+	if _, err := db.IncrementMany(map[string]int64{"misses": 1, "text": 1}); ErrNotCounter != err {
+		t.Errorf("Expected ErrNotCounter, got %v", err)
+	}
+	if has, _ := db.HasS("misses"); has {
+		t.Errorf("Failed IncrementMany was not rolled back")
+	}
+	values, err := db.IncrementMany(map[string]int64{"misses": 3, "hits": -350})
+	checkErr(err)
+	if 3 != values["misses"] || 0 != values["hits"] {
+		t.Errorf("IncrementMany returned %v", values)
+	}
+	if n, _ := db.Counter([]byte("misses")); 3 != n {
+		t.Errorf("Counter returned %d", n)
+	}
+}
+
+func TestExpiryLegacyValues(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_expiry_legacy")
+	checkErr(err)
+
+	// Start from a database that has never used expiry times.
+	var keys []string
+	checkErr(db.Each(GTE, nil, func(key, value []byte) {
+		keys = append(keys, string(key))
+	}))
+	for _, k := range keys {
+		checkErr(db.DeleteS(k))
+	}
+	checkErr(db.delete(expiryFlag))
+	db.expiring = false
+
+	legacy := map[string]string{
+		"city":   "Łódź is a city in Poland",
+		"binary": "\xf8\x00\x00\x00\x00\x00\x00\x00\x01 binary",
+	}
+	check := func(when string) {
+		for k, v := range legacy {
+			if got, err := db.GetSS(k); v != got {
+				t.Errorf("%s, %s read as %q (%v)", when, k, got, err)
+			}
+		}
+	}
+	for k, v := range legacy {
+		checkErr(db.SetSS(k, v))
+	}
+	if raw, _ := db.get([]byte("binary")); legacy["binary"] != string(raw) {
+		t.Errorf("Value stored with a header before expiry was used: %q", raw)
+	}
+	check("Before expiry was used")
+	checkErr(db.SetWithTTL([]byte("session"), []byte("x"), time.Hour))
+	check("After expiry was used")
+	checkErr(db.Close())
+
+	db, err = Open(Create, "testdb_expiry_legacy")
+	checkErr(err)
+	defer db.Close()
+	check("After reopening")
+	if ttl, _ := db.TTL([]byte("session")); 0 >= ttl {
+		t.Errorf("Expiry time lost after reopening")
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db, err := Open(Create, "testdb_conditional")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DeleteS("k")
+
+	k := []byte("k")
+	expect := func(what string, ok bool, err error, want bool) {
+		if nil != err {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if ok != want {
+			t.Errorf("%s returned %v, expected %v", what, ok, want)
+		}
+	}
+	ok, err := db.Replace(k, []byte("a"))
+	expect("Replace of absent key", ok, err, false)
+	ok, err = db.SetIfAbsent(k, []byte("a"))
+	expect("SetIfAbsent of absent key", ok, err, true)
+	ok, err = db.SetIfAbsent(k, []byte("b"))
+	expect("SetIfAbsent of present key", ok, err, false)
+	ok, err = db.CompareAndSwap(k, []byte("b"), []byte("c"))
+	expect("CompareAndSwap with wrong value", ok, err, false)
+	ok, err = db.CompareAndSwap(k, []byte("a"), []byte("c"))
+	expect("CompareAndSwap with right value", ok, err, true)
+	ok, err = db.Replace(k, []byte("d"))
+	expect("Replace of present key", ok, err, true)
+	ok, err = db.DeleteIfEquals(k, []byte("c"))
+	expect("DeleteIfEquals with wrong value", ok, err, false)
+	ok, err = db.DeleteIfEquals(k, []byte("d"))
+	expect("DeleteIfEquals with right value", ok, err, true)
+	if db.MustHas(k) {
+		t.Errorf("DeleteIfEquals did not delete the key")
+	}
+
+	// Conditional writes keep the expiry time, and reject empty values.
+	if err = db.SetWithTTL(k, []byte("a"), time.Hour); nil != err {
+		t.Fatal(err)
+	}
+	ok, err = db.CompareAndSwap(k, []byte("a"), []byte("b"))
+	expect("CompareAndSwap of expiring key", ok, err, true)
+	if ttl, err := db.TTL(k); time.Hour < ttl || time.Hour-time.Minute > ttl {
+		t.Errorf("CompareAndSwap lost the TTL: %v (%v)", ttl, err)
+	}
+	if err = db.SetWithTTL(k, []byte("a"), -time.Second); nil != err {
+		t.Fatal(err)
+	}
+	ok, err = db.SetIfAbsent(k, []byte("b"))
+	expect("SetIfAbsent of expired key", ok, err, true)
+	if ttl, err := db.TTL(k); 0 != ttl {
+		t.Errorf("SetIfAbsent kept the TTL of an expired key: %v (%v)", ttl, err)
+	}
+	if _, err = db.CompareAndSwap(k, []byte("b"), []byte{}); ErrEmptyValue != err {
+		t.Errorf("Expected ErrEmptyValue from CompareAndSwap, got %v", err)
+	}
+	if _, err = db.SetIfAbsent([]byte("absent"), nil); ErrEmptyValue != err {
+		t.Errorf("Expected ErrEmptyValue from SetIfAbsent, got %v", err)
+	}
+	db.DeleteS("k")
+}
+
+func TestMerge(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_merge")
+	checkErr(err)
+	defer db.Close()
+	for _, k := range []string{"log", "sum", "max", "tags", "other"} {
+		checkErr(db.DeleteS(k))
+	}
+	checkErr(db.MergeOperator([]byte("log"), "append"))
+	checkErr(db.MergeOperator([]byte("sum"), "sum"))
+	checkErr(db.MergeOperator([]byte("max"), "max"))
+	checkErr(db.MergeOperator([]byte("tags"), "union"))
+	if ErrNoMergeOperator != db.Merge([]byte("other"), []byte("x")) {
+		t.Errorf("Expected ErrNoMergeOperator")
+	}
+
+	operand := func(n int64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(n))
+		return b
+	}
+	merge := func() {
+		for _, s := range []string{"a", "b", "c"} {
+			checkErr(db.Merge([]byte("log"), []byte(s)))
+			checkErr(db.Merge([]byte("max"), []byte(s)))
+			checkErr(db.Merge([]byte("tags"), EncodeSet([]byte(s), []byte("a"))))
+		}
+		checkErr(db.Merge([]byte("sum"), operand(5)))
+		checkErr(db.Merge([]byte("sum"), operand(-2)))
+	}
+	check := func(log string, sum int64) {
+		if v, _ := db.GetSS("log"); log != v {
+			t.Errorf("Expected log %q, got %q", log, v)
+		}
+		if v, _ := db.GetSS("max"); "c" != v {
+			t.Errorf("Expected max c, got %q", v)
+		}
+		if n, err := db.Counter([]byte("sum")); sum != n {
+			t.Errorf("Expected sum %d, got %d (%v)", sum, n, err)
+		}
+		tags, err := DecodeSet(db.MustGet([]byte("tags")))
+		checkErr(err)
+		if !reflect.DeepEqual([][]byte{[]byte("a"), []byte("b"), []byte("c")}, tags) {
+			t.Errorf("Unexpected tags %q", tags)
+		}
+	}
+	merge()
+	check("abc", 3)
+
+	checkErr(db.DeferMerges(true))
+	merge()
+	check("abcabc", 6)
+	n, err := db.CompactMerges()
+	checkErr(err)
+	if 4 != n {
+		t.Errorf("Expected 4 keys compacted, got %d", n)
+	}
+	check("abcabc", 6)
+
+	checkErr(db.Merge([]byte("log"), []byte("d")))
+	checkErr(db.SetSS("log", "x"))
+	checkErr(db.Merge([]byte("log"), []byte("y")))
+	if v, _ := db.GetSS("log"); "xy" != v {
+		t.Errorf("Set did not discard deferred operands: got %q", v)
+	}
+	if ok, err := db.CompareAndSwap([]byte("log"), []byte("xy"), []byte("z")); !ok || nil != err {
+		t.Errorf("CompareAndSwap did not see deferred operands: %v, %v", ok, err)
+	}
+	if v, _ := db.GetSS("log"); "z" != v {
+		t.Errorf("Expected z after CompareAndSwap, got %q", v)
+	}
+
+	// Writes that read the key see its deferred operands.
+	checkErr(db.Merge([]byte("sum"), operand(4)))
+	if n, err := db.Increment([]byte("sum"), 1); 11 != n {
+		t.Errorf("Expected sum 11 after Increment, got %d (%v)", n, err)
+	}
+	checkErr(db.Merge([]byte("log"), []byte("w")))
+	checkErr(db.Expire([]byte("log"), time.Hour))
+	if v, _ := db.GetSS("log"); "zw" != v {
+		t.Errorf("Expire discarded deferred operands: got %q", v)
+	}
+
+	// Empty merged values delete the key.
+	for _, deferred := range []bool{true, false} {
+		checkErr(db.DeferMerges(deferred))
+		checkErr(db.DeleteS("log"))
+		checkErr(db.DeleteS("tags"))
+		checkErr(db.Merge([]byte("log"), []byte{}))
+		checkErr(db.Merge([]byte("tags"), EncodeSet()))
+		_, err = db.CompactMerges()
+		checkErr(err)
+		for _, k := range []string{"log", "tags"} {
+			if db.MustHasS(k) {
+				t.Errorf("Empty merged value of %s was stored", k)
+			}
+		}
+	}
+
+	// Operands deferred after reopening are applied after those already
+	// stored.
+	reopened, err := Open(Create, "testdb_merge_seq")
+	checkErr(err)
+	checkErr(reopened.DeleteS("log"))
+	checkErr(reopened.MergeOperator([]byte("log"), "append"))
+	checkErr(reopened.DeferMerges(true))
+	checkErr(reopened.Merge([]byte("log"), []byte("a")))
+	checkErr(reopened.Close())
+	reopened, err = Open(Create, "testdb_merge_seq")
+	checkErr(err)
+	checkErr(reopened.MergeOperator([]byte("log"), "append"))
+	checkErr(reopened.DeferMerges(true))
+	checkErr(reopened.Merge([]byte("log"), []byte("b")))
+	if v, err := reopened.GetSS("log"); "ab" != v {
+		t.Errorf("Expected ab after reopening, got %q (%v)", v, err)
+	}
+	checkErr(reopened.Close())
+}
+
+func TestQueue(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_queue")
+	checkErr(err)
+	q, err := db.Queue("jobs")
+	checkErr(err)
+	for {
+		if _, err := q.Pop(); ErrQueueEmpty == err {
+			break
+		}
+		checkErr(err)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		_, err := q.Push([]byte(s))
+		checkErr(err)
+	}
+	checkErr(db.Close())
+
+	// The queue must be recovered after reopening the database.
+	db, err = Open(Create, "testdb_queue")
+	checkErr(err)
+	q, err = db.Queue("jobs")
+	checkErr(err)
+	if v, err := q.Peek(); "a" != string(v) {
+		t.Errorf("Peek returned %q (%v), expected a", v, err)
+	}
+	if v, err := q.Pop(); "a" != string(v) {
+		t.Errorf("Pop returned %q (%v), expected a", v, err)
+	}
+	// The lease has already expired when it is reserved.
+	m, err := q.Reserve(-time.Millisecond)
+	checkErr(err)
+	if "b" != string(m.Value) {
+		t.Errorf("Reserve returned %q, expected b", m.Value)
+	}
+	if ErrLeaseExpired != q.Ack(m) {
+		t.Errorf("Expected ErrLeaseExpired")
+	}
+	m2, err := q.Reserve(time.Minute)
+	checkErr(err)
+	if m.ID != m2.ID {
+		t.Errorf("Expired message was not redelivered first")
+	}
+	if v, _ := q.Peek(); "c" != string(v) {
+		t.Errorf("Reserved message is still visible")
+	}
+	checkErr(q.Ack(m2))
+	if _, err := q.Push([]byte("d")); nil != err {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"c", "d"} {
+		if v, err := q.Pop(); s != string(v) {
+			t.Errorf("Pop returned %q (%v), expected %s", v, err, s)
+		}
+	}
+	if _, err := q.Pop(); ErrQueueEmpty != err {
+		t.Errorf("Expected ErrQueueEmpty, got %v", err)
+	}
+	_, err = q.Push([]byte{})
+	checkErr(err)
+	if v, err := q.Pop(); nil != err || 0 != len(v) {
+		t.Errorf("Pop returned %q (%v), expected an empty message", v, err)
+	}
+
+	// Sequence numbers are not reused once the queue has been drained.
+	last, err := q.Push([]byte("e"))
+	checkErr(err)
+	_, err = q.Pop()
+	checkErr(err)
+	checkErr(db.Close())
+	db, err = Open(Create, "testdb_queue")
+	checkErr(err)
+	defer db.Close()
+	q, err = db.Queue("jobs")
+	checkErr(err)
+	if id, err := q.Push([]byte("f")); nil != err || id <= last {
+		t.Errorf("Push after draining returned %d (%v), expected more than %d", id, err, last)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_sequence")
+	checkErr(err)
+	defer db.Close()
+
+	seen := make(map[uint64]bool)
+	next := func(s *Sequence) uint64 {
+		id, err := s.Next()
+		checkErr(err)
+		if seen[id] {
+			t.Fatalf("Sequence returned duplicate ID %d", id)
+		}
+		seen[id] = true
+		return id
+	}
+	a, b := db.Sequence("ids", 10), db.Sequence("ids", 10)
+	first := next(a)
+	for i := 0; i < 25; i++ {
+		next(a)
+		next(b)
+	}
+	// A new Sequence, as after a restart, skips the unused leased IDs.
+	if id := next(db.Sequence("ids", 10)); id <= first+50 {
+		t.Errorf("Restarted sequence returned %d, which may have been leased", id)
+	}
+
+	seen = make(map[uint64]bool)
+	c := db.Sequence("released", 100)
+	id := next(c)
+	checkErr(c.Release())
+	if again := next(db.Sequence("released", 100)); id+1 != again {
+		t.Errorf("Expected %d after Release, got %d", id+1, again)
+	}
+	if next(c) <= id+1 {
+		t.Errorf("Sequence reused an ID after Release")
+	}
+
+	checkErr(db.Begin())
+	if _, err := db.Sequence("ids", 10).Next(); ErrTransactionInProgress != err {
+		t.Errorf("Expected ErrTransactionInProgress, got %v", err)
+	}
+	checkErr(db.Rollback())
+
+	// A corrupt high water mark is an error.
+	db.lock.Lock()
+	checkErr(db.set(sysKey("sequence", "corrupt"), []byte{1, 2, 3}))
+	db.lock.Unlock()
+	if _, err := db.Sequence("corrupt", 10).Next(); nil == err {
+		t.Errorf("Expected an error from a corrupt Sequence")
+	}
+	db.lock.Lock()
+	checkErr(db.delete(sysKey("sequence", "corrupt")))
+	db.lock.Unlock()
+}
+
+func TestBlobs(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_blob")
+	checkErr(err)
+	defer db.Close()
+	key := []byte("blob")
+	db.DeleteBlob(key)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	w := db.CreateBlob(key, 1024)
+	for p := data; 0 < len(p); {
+		n := 300
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err := w.Write(p[:n])
+		checkErr(err)
+		p = p[n:]
+	}
+	if _, err := db.OpenBlob(key); ErrNotFound != err {
+		t.Errorf("Blob was visible before Close: %v", err)
+	}
+	checkErr(w.Close())
+
+	r, err := db.OpenBlob(key)
+	checkErr(err)
+	if int64(len(data)) != r.Size() {
+		t.Errorf("Expected size %d, got %d", len(data), r.Size())
+	}
+	read, err := io.ReadAll(r)
+	checkErr(err)
+	if !bytes.Equal(data, read) {
+		t.Errorf("Blob read back differently")
+	}
+	_, err = r.Seek(-100, io.SeekEnd)
+	checkErr(err)
+	buf := make([]byte, 50)
+	_, err = io.ReadFull(r, buf)
+	checkErr(err)
+	if !bytes.Equal(data[len(data)-100:len(data)-50], buf) {
+		t.Errorf("Read after Seek returned the wrong data")
+	}
+
+	// Replacing and aborting must leave no stray chunks.
+	w = db.CreateBlob(key, 0)
+	w.Write([]byte("replaced"))
+	checkErr(w.Close())
+	w = db.CreateBlob(key, 0)
+	w.Write([]byte("aborted"))
+	checkErr(w.Abort())
+	r, err = db.OpenBlob(key)
+	checkErr(err)
+	if read, _ := io.ReadAll(r); "replaced" != string(read) {
+		t.Errorf("Expected replaced blob, got %q", read)
+	}
+
+	// Writers of the same blob each store their own generation, whenever
+	// they were created, and an empty blob replaces the previous one.
+	first, second := db.CreateBlob(key, 0), db.CreateBlob(key, 0)
+	first.Write([]byte("first"))
+	second.Write([]byte("second"))
+	checkErr(first.Close())
+	checkErr(second.Close())
+	r, err = db.OpenBlob(key)
+	checkErr(err)
+	if read, _ := io.ReadAll(r); "second" != string(read) {
+		t.Errorf("Expected second blob, got %q", read)
+	}
+	checkErr(db.CreateBlob(key, 0).Close())
+	r, err = db.OpenBlob(key)
+	checkErr(err)
+	if 0 != r.Size() {
+		t.Errorf("Expected empty blob, got %d bytes", r.Size())
+	}
+	checkErr(db.DeleteBlob(key))
+	db.lock.Lock()
+	chunks, _, err := db.readBatch(GTE, sysKey("blob", key), sysKey("blob", key), 1)
+	db.lock.Unlock()
+	checkErr(err)
+	if 0 != len(chunks) {
+		t.Errorf("DeleteBlob left chunks behind")
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_text")
+	checkErr(err)
+	defer db.Close()
+	db.AddTextIndex("body", JSONTextFields("title", "body"), nil)
+	docs := map[string]string{
+		"d1": `{"title": "Gophers", "body": "Gophers dig tunnels. Gophers eat roots."}`,
+		"d2": `{"title": "Databases", "body": "Sophia is an embedded database."}`,
+		"d3": `{"title": "Gophers and databases", "body": "A gopher using a database"}`,
+	}
+	for k, v := range docs {
+		checkErr(db.SetSS(k, v))
+	}
+	checkErr(db.SetSS("d4", `{"title": "Removed gophers"}`))
+	checkErr(db.DeleteS("d4"))
+	checkErr(db.RebuildIndex("body"))
+
+	keys := func(q TextQuery) []string {
+		results, err := db.Search("body", q, 0)
+		checkErr(err)
+		var keys []string
+		for _, r := range results {
+			keys = append(keys, string(r.Key))
+		}
+		return keys
+	}
+	for _, c := range []struct {
+		query TextQuery
+		keys  []string
+	}{
+		{Term("gophers"), []string{"d1", "d3"}},
+		{Term("tunnels"), []string{"d1"}},
+		{And(Term("gophers"), Term("databases")), []string{"d3"}},
+		{Or(Term("tunnels"), Term("sophia")), []string{"d1", "d2"}},
+		{Prefix("data"), []string{"d2", "d3"}},
+		{Term("missing"), nil},
+	} {
+		if got := keys(c.query); !reflect.DeepEqual(c.keys, got) {
+			t.Errorf("Query %v returned %v, expected %v", c.query, got, c.keys)
+		}
+	}
+
+	checkErr(db.SetSS("d1", `{"title": "Moles"}`))
+	if got := keys(Term("tunnels")); 0 != len(got) {
+		t.Errorf("Overwritten row still matched: %v", got)
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_timeseries")
+	checkErr(err)
+	defer db.Close()
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cpu := db.Series("cpu", map[string]string{"host": "a", "dc": "x"})
+	other := db.Series("cpu", map[string]string{"host": "b"})
+	for i := 0; i < 6; i++ {
+		checkErr(cpu.Add(base.Add(time.Duration(i)*20*time.Second), float64(i)))
+	}
+	checkErr(other.Add(base, 100))
+
+	var values []float64
+	checkErr(cpu.Range(base.Add(20*time.Second), base.Add(time.Minute+20*time.Second), func(_ time.Time, v float64) error {
+		values = append(values, v)
+		return nil
+	}))
+	if !reflect.DeepEqual([]float64{1, 2, 3}, values) {
+		t.Errorf("Range returned %v", values)
+	}
+	aggs, err := cpu.Aggregate(base, base.Add(time.Hour), time.Minute)
+	checkErr(err)
+	if 2 != len(aggs) || 3 != aggs[0].Count || 0 != aggs[0].Min || 2 != aggs[0].Max || 12 != aggs[1].Sum || 4 != aggs[1].Avg() {
+		t.Errorf("Aggregate returned %+v", aggs)
+	}
+
+	if err := cpu.SetRetention(RetentionPolicy{
+		Raw:     time.Minute,
+		Rollups: []Rollup{{Window: time.Hour}},
+	}); nil == err {
+		t.Errorf("Expected an error for raw retention shorter than a window")
+	}
+	checkErr(cpu.SetRetention(RetentionPolicy{
+		Raw:     time.Hour,
+		Rollups: []Rollup{{Window: time.Minute}},
+	}))
+	checkErr(db.Downsample())
+	if aggs, err := cpu.Aggregate(base, base.Add(time.Hour), time.Minute); nil != err || 0 != len(aggs) {
+		t.Errorf("Raw points were not deleted: %+v (%v)", aggs, err)
+	}
+	rollups, err := cpu.Rollups(time.Minute, base, base.Add(time.Hour))
+	checkErr(err)
+	if 2 != len(rollups) || !rollups[1].Start.Equal(base.Add(time.Minute)) || 5 != rollups[1].Max {
+		t.Errorf("Rollups returned %+v", rollups)
+	}
+	if aggs, _ := other.Aggregate(base, base.Add(time.Hour), time.Minute); 1 != len(aggs) {
+		t.Errorf("Series without a policy was downsampled")
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_documents")
+	checkErr(err)
+	defer db.Close()
+	db.DeleteBucket("people")
+	people, err := db.Collection("people")
+	checkErr(err)
+	people.AddIndex("age")
+	people.AddIndex("active")
+
+	type person struct {
+		Name    string            `json:"name"`
+		Age     int               `json:"age"`
+		Active  bool              `json:"active"`
+		Address map[string]string `json:"address"`
+		Tags    []string          `json:"tags"`
+	}
+	for id, p := range map[string]person{
+		"1": {"Ann", 31, true, map[string]string{"city": "Cape Town"}, []string{"admin"}},
+		"2": {"Bob", 25, false, map[string]string{"city": "Durban"}, []string{"dev", "admin"}},
+		"3": {"Cat", 42, true, map[string]string{"city": "Cape Town"}, nil},
+	} {
+		checkErr(people.Put([]byte(id), p))
+	}
+	var p person
+	checkErr(people.Get([]byte("2"), &p))
+	if "Bob" != p.Name {
+		t.Errorf("Get returned %+v", p)
+	}
+
+	ids := func(preds ...Predicate) []string {
+		docs, err := people.Find(preds...)
+		checkErr(err)
+		var ids []string
+		for _, d := range docs {
+			ids = append(ids, string(d.ID))
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	for _, c := range []struct {
+		preds []Predicate
+		ids   []string
+	}{
+		{[]Predicate{Eq("address.city", "Cape Town")}, []string{"1", "3"}},
+		{[]Predicate{Eq("tags", "admin")}, []string{"1", "2"}},
+		{[]Predicate{Eq("tags.0", "admin")}, []string{"1"}},
+		{[]Predicate{Gt("age", 30)}, []string{"1", "3"}},
+		{[]Predicate{Gte("age", 25), Lt("age", 42)}, []string{"1", "2"}},
+		{[]Predicate{Lte("age", 31), Eq("address.city", "Cape Town")}, []string{"1"}},
+		{[]Predicate{Eq("age", "31")}, nil},
+		{[]Predicate{Gte("age", int32(31)), Lt("age", uint(42))}, []string{"1"}},
+		{[]Predicate{Eq("age", float32(25))}, []string{"2"}},
+		{[]Predicate{Gt("active", false)}, []string{"1", "3"}},
+		{[]Predicate{Lt("active", true)}, []string{"2"}},
+		{[]Predicate{Gte("active", false), Eq("address.city", "Durban")}, []string{"2"}},
+	} {
+		if got := ids(c.preds...); !reflect.DeepEqual(c.ids, got) {
+			t.Errorf("Find(%v) returned %v, expected %v", c.preds, got, c.ids)
+		}
+	}
+
+	checkErr(people.Delete([]byte("1")))
+	if got := ids(Gt("age", 30)); !reflect.DeepEqual([]string{"3"}, got) {
+		t.Errorf("Deleted document was found: %v", got)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_graph")
+	checkErr(err)
+	defer db.Close()
+	g := db.Graph("social")
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		g.DeleteNode([]byte(n))
+		checkErr(g.SetNode([]byte(n), []byte("node "+n)))
+	}
+	for _, e := range [][3]string{
+		{"a", "follows", "b"}, {"b", "follows", "c"}, {"c", "follows", "d"},
+		{"a", "blocks", "d"}, {"e", "follows", "a"},
+	} {
+		checkErr(g.AddEdge([]byte(e[0]), e[1], []byte(e[2]), nil))
+	}
+	checkErr(g.AddEdge([]byte("b"), "likes", []byte("e"), []byte("a lot")))
+	if v, err := g.EdgeValue([]byte("b"), "likes", []byte("e")); "a lot" != string(v) {
+		t.Errorf("EdgeValue returned %q (%v)", v, err)
+	}
+	checkErr(g.RemoveEdge([]byte("b"), "likes", []byte("e")))
+	checkErr(g.SetNode([]byte("f"), nil))
+	if v, err := g.Node([]byte("f")); nil != err || 0 != len(v) {
+		t.Errorf("Node returned %q (%v), expected an empty value", v, err)
+	}
+	checkErr(g.DeleteNode([]byte("f")))
+
+	neighbors := func(id string, dir Direction, label string) []string {
+		var ids []string
+		checkErr(g.Neighbors([]byte(id), dir, label, func(e Edge) error {
+			ids = append(ids, e.Label+":"+string(e.next(dir)))
+			return nil
+		}))
+		return ids
+	}
+	if got := neighbors("a", Outgoing, ""); !reflect.DeepEqual([]string{"blocks:d", "follows:b"}, got) {
+		t.Errorf("Outgoing neighbors of a: %v", got)
+	}
+	if got := neighbors("d", Incoming, "follows"); !reflect.DeepEqual([]string{"follows:c"}, got) {
+		t.Errorf("Incoming followers of d: %v", got)
+	}
+
+	var visited []string
+	checkErr(g.BFS([]byte("e"), Outgoing, "follows", 2, func(id []byte, depth int) error {
+		visited = append(visited, fmt.Sprintf("%s%d", id, depth))
+		return nil
+	}))
+	if !reflect.DeepEqual([]string{"e0", "a1", "b2"}, visited) {
+		t.Errorf("BFS visited %v", visited)
+	}
+	path, err := g.ShortestPath([]byte("e"), []byte("d"), Outgoing, "", 5)
+	checkErr(err)
+	if !reflect.DeepEqual([][]byte{[]byte("e"), []byte("a"), []byte("d")}, path) {
+		t.Errorf("ShortestPath returned %q", path)
+	}
+	if _, err := g.ShortestPath([]byte("e"), []byte("d"), Outgoing, "follows", 3); ErrNoPath != err {
+		t.Errorf("Expected ErrNoPath within depth 3, got %v", err)
+	}
+	if err := g.BFS([]byte("e"), Outgoing, "", -1, func([]byte, int) error { return nil }); nil == err {
+		t.Errorf("Expected an error for a negative depth")
+	}
+
+	checkErr(g.DeleteNode([]byte("a")))
+	if got := neighbors("e", Outgoing, ""); 0 != len(got) {
+		t.Errorf("Edges to a deleted node remain: %v", got)
+	}
+	if got := neighbors("b", Incoming, ""); 0 != len(got) {
+		t.Errorf("Edges from a deleted node remain: %v", got)
+	}
+}
+
+func TestGeoIndex(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_geo")
+	checkErr(err)
+	defer db.Close()
+	g := db.GeoIndex("places")
+	places := map[string][2]float64{
+		"capetown":   {-33.9249, 18.4241},
+		"stellenbos": {-33.9321, 18.8602},
+		"durban":     {-29.8587, 31.0218},
+		"london":     {51.5074, -0.1278},
+		"suva":       {-18.1416, 178.4419},
+		"apia":       {-13.8333, -171.7500},
+	}
+	for id, p := range places {
+		checkErr(g.Add([]byte(id), p[0], p[1]))
+	}
+	// Moving a point must remove it from its old position.
+	checkErr(g.Add([]byte("london"), 48.8566, 2.3522))
+	if ErrInvalidCoordinates != g.Add([]byte("x"), 91, 0) {
+		t.Errorf("Expected ErrInvalidCoordinates")
+	}
+
+	ids := func(points []GeoPoint, err error) []string {
+		checkErr(err)
+		var ids []string
+		for _, p := range points {
+			ids = append(ids, string(p.ID))
+		}
+		return ids
+	}
+	sorted := func(ids []string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+	if got := sorted(ids(g.WithinBox(-35, 17, -29, 32))); !reflect.DeepEqual([]string{"capetown", "durban", "stellenbos"}, got) {
+		t.Errorf("WithinBox returned %v", got)
+	}
+	if got := ids(g.WithinBox(50, -1, 52, 1)); 0 != len(got) {
+		t.Errorf("Moved point found at its old position: %v", got)
+	}
+	if got := sorted(ids(g.WithinBox(-20, 170, -10, -170))); !reflect.DeepEqual([]string{"apia", "suva"}, got) {
+		t.Errorf("WithinBox across the antimeridian returned %v", got)
+	}
+	if got := ids(g.WithinRadius(-33.92, 18.42, 50000)); !reflect.DeepEqual([]string{"capetown", "stellenbos"}, got) {
+		t.Errorf("WithinRadius returned %v", got)
+	}
+	if got := ids(g.WithinRadius(-33.92, 18.42, 10000)); !reflect.DeepEqual([]string{"capetown"}, got) {
+		t.Errorf("WithinRadius returned %v", got)
+	}
+	if d := Distance(-33.9249, 18.4241, -29.8587, 31.0218); 1.2e6 > d || 1.3e6 < d {
+		t.Errorf("Unexpected distance from Cape Town to Durban: %v", d)
+	}
+	checkErr(g.Remove([]byte("capetown")))
+	if got := ids(g.WithinRadius(-33.92, 18.42, 10000)); 0 != len(got) {
+		t.Errorf("Removed point was found: %v", got)
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_zset")
+	checkErr(err)
+	defer db.Close()
+	z := db.SortedSet("scores")
+	for _, m := range []string{"ann", "bob", "cat", "dan", "eve"} {
+		z.Remove([]byte(m))
+	}
+	for m, s := range map[string]float64{"ann": 10, "bob": -5, "cat": 30, "dan": 10, "eve": 20} {
+		added, err := z.Add([]byte(m), s)
+		checkErr(err)
+		if !added {
+			t.Errorf("Add of new member %s returned false", m)
+		}
+	}
+	if added, _ := z.Add([]byte("eve"), 40); added {
+		t.Errorf("Add of existing member returned true")
+	}
+	if n, _ := z.Len(); 5 != n {
+		t.Errorf("Expected 5 members, got %d", n)
+	}
+
+	members := func(ms []ScoredMember, err error) string {
+		checkErr(err)
+		var s []string
+		for _, m := range ms {
+			s = append(s, fmt.Sprintf("%s:%v", m.Member, m.Score))
+		}
+		return strings.Join(s, " ")
+	}
+	if got := members(z.RangeByScore(0, 30, GTE)); "ann:10 dan:10 cat:30" != got {
+		t.Errorf("RangeByScore returned %s", got)
+	}
+	if got := members(z.RangeByScore(10, 40, LTE)); "eve:40 cat:30 dan:10 ann:10" != got {
+		t.Errorf("Reverse RangeByScore returned %s", got)
+	}
+	if got := members(z.RangeByRank(0, 1, GTE)); "bob:-5 ann:10" != got {
+		t.Errorf("RangeByRank returned %s", got)
+	}
+	if got := members(z.RangeByRank(-2, -1, LT)); "ann:10 bob:-5" != got {
+		t.Errorf("Reverse RangeByRank returned %s", got)
+	}
+	if r, _ := z.Rank([]byte("cat"), GTE); 3 != r {
+		t.Errorf("Expected rank 3, got %d", r)
+	}
+	if r, _ := z.Rank([]byte("cat"), LTE); 1 != r {
+		t.Errorf("Expected reverse rank 1, got %d", r)
+	}
+	removed, err := z.Remove([]byte("eve"))
+	checkErr(err)
+	if _, err := z.Score([]byte("eve")); !removed || ErrNotFound != err {
+		t.Errorf("Remove did not remove the member")
+	}
+	if got := members(z.RangeByRank(0, -1, LTE)); "cat:30 dan:10 ann:10 bob:-5" != got {
+		t.Errorf("RangeByRank after Remove returned %s", got)
+	}
+}
+
+func TestHashSetList(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_composite")
+	checkErr(err)
+	defer db.Close()
+
+	h := db.Hash("user")
+	_, err = h.Delete([]byte("name"), []byte("email"), []byte("bio"))
+	checkErr(err)
+	checkErr(h.SetMany(map[string][]byte{"name": []byte("Ann"), "email": []byte("ann@example.com"), "bio": {}}))
+	checkErr(h.Set([]byte("name"), []byte("Anne")))
+	if n, _ := h.Len(); 3 != n {
+		t.Errorf("Expected 3 fields, got %d", n)
+	}
+	if v, _ := h.Get([]byte("name")); "Anne" != string(v) {
+		t.Errorf("Expected Anne, got %s", v)
+	}
+	all, err := h.All()
+	checkErr(err)
+	if 3 != len(all) || "ann@example.com" != string(all["email"]) || 0 != len(all["bio"]) {
+		t.Errorf("All returned %v", all)
+	}
+	removed, err := h.Delete([]byte("bio"), []byte("missing"))
+	checkErr(err)
+	if n, _ := h.Len(); 1 != removed || 2 != n {
+		t.Errorf("Delete removed %d fields, leaving %d", removed, n)
+	}
+
+	s := db.MemberSet("tags")
+	_, err = s.Remove([]byte("go"), []byte("db"), []byte("kv"))
+	checkErr(err)
+	added, err := s.Add([]byte("go"), []byte("db"), []byte("go"))
+	checkErr(err)
+	if 2 != added {
+		t.Errorf("Expected 2 members added, got %d", added)
+	}
+	if added, _ = s.Add([]byte("kv"), []byte("db")); 1 != added {
+		t.Errorf("Expected 1 member added, got %d", added)
+	}
+	members, err := s.Members()
+	checkErr(err)
+	if !reflect.DeepEqual([][]byte{[]byte("db"), []byte("go"), []byte("kv")}, members) {
+		t.Errorf("Members returned %q", members)
+	}
+	if ok, _ := s.Has([]byte("go")); !ok {
+		t.Errorf("Has returned false for a member")
+	}
+	if removed, _ = s.Remove([]byte("go"), []byte("rust")); 1 != removed {
+		t.Errorf("Expected 1 member removed, got %d", removed)
+	}
+	if n, _ := s.Len(); 2 != n {
+		t.Errorf("Expected 2 members, got %d", n)
+	}
+
+	l := db.List("jobs")
+	for n, _ := l.Len(); 0 < n; n-- {
+		_, err = l.PopFront()
+		checkErr(err)
+	}
+	n, err := l.PushBack([]byte("b"), []byte("c"))
+	checkErr(err)
+	if n, err = l.PushFront([]byte("a"), []byte("z")); 4 != n {
+		t.Errorf("Expected length 4, got %d", n)
+	}
+	checkErr(err)
+	checkErr(l.SetIndex(-1, []byte("d")))
+	values, err := l.Range(0, -1)
+	checkErr(err)
+	if got := string(bytes.Join(values, nil)); "zabd" != got {
+		t.Errorf("Range returned %s", got)
+	}
+	if v, _ := l.Index(1); "a" != string(v) {
+		t.Errorf("Expected a at index 1, got %s", v)
+	}
+	if _, err = l.Index(4); ErrIndexOutOfRange != err {
+		t.Errorf("Expected ErrIndexOutOfRange, got %v", err)
+	}
+	if v, _ := l.PopBack(); "d" != string(v) {
+		t.Errorf("PopBack returned %s", v)
+	}
+	if v, _ := l.PopFront(); "z" != string(v) {
+		t.Errorf("PopFront returned %s", v)
+	}
+	if n, _ = l.Len(); 2 != n {
+		t.Errorf("Expected length 2, got %d", n)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_versions")
+	checkErr(err)
+	defer db.Close()
+	key := []byte("doc")
+	db.Delete(key)
+	db.Versioning(&VersionPolicy{})
+	checkErr(db.PruneVersions())
+
+	for _, v := range []string{"one", "two", "three"} {
+		checkErr(db.Set(key, []byte(v)))
+	}
+	checkErr(db.Delete(key))
+	// The times of the versions just written are the last four.
+	versions, err := db.Versions(key)
+	checkErr(err)
+	if 4 > len(versions) {
+		t.Fatalf("Expected at least 4 versions, got %v", versions)
+	}
+	var times []time.Time
+	for _, v := range versions[len(versions)-4:] {
+		times = append(times, v.Time)
+	}
+	deleted := times[3]
+	if v, _ := db.GetAsOf(key, times[0]); "one" != string(v) {
+		t.Errorf("Expected one, got %s", v)
+	}
+	if v, _ := db.GetAsOf(key, times[1]); "two" != string(v) {
+		t.Errorf("Expected two, got %s", v)
+	}
+	if _, err = db.GetAsOf(key, deleted); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	checkErr(db.Set(key, []byte("four")))
+	if v, _ := db.Get(key); "four" != string(v) {
+		t.Errorf("Get returned %s", v)
+	}
+
+	versions, err = db.Versions(key)
+	checkErr(err)
+	// The versions left by earlier runs are pruned below.
+	if n := len(versions); 5 > n || !versions[n-2].Deleted || "three" != string(versions[n-3].Value) {
+		t.Errorf("Unexpected versions %v", versions)
+	}
+	db.Versioning(&VersionPolicy{MaxVersions: 2})
+	checkErr(db.Set(key, []byte("five")))
+	versions, err = db.Versions(key)
+	checkErr(err)
+	if 2 != len(versions) || "four" != string(versions[0].Value) || "five" != string(versions[1].Value) {
+		t.Errorf("Expected 2 versions, got %v", versions)
+	}
+	if _, err = db.GetAsOf(key, times[2]); ErrNotFound != err {
+		t.Errorf("Expected pruned version to be ErrNotFound, got %v", err)
+	}
+	db.Versioning(&VersionPolicy{MaxAge: time.Nanosecond})
+	checkErr(db.PruneVersions())
+	if versions, _ = db.Versions(key); 1 != len(versions) || "five" != string(versions[0].Value) {
+		t.Errorf("Expected only the newest version, got %v", versions)
+	}
+
+	// Compacting merges only rewrites the value, so it adds no version.
+	db.Versioning(&VersionPolicy{})
+	checkErr(db.MergeOperator(key, "append"))
+	checkErr(db.DeferMerges(true))
+	checkErr(db.Merge(key, []byte(" six")))
+	checkErr(db.DeferMerges(false))
+	_, err = db.CompactMerges()
+	checkErr(err)
+	if v, _ := db.Get(key); "five six" != string(v) {
+		t.Errorf("Get returned %s after compaction", v)
+	}
+	if versions, _ = db.Versions(key); 1 != len(versions) {
+		t.Errorf("Compaction added versions %v", versions)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_softdelete")
+	checkErr(err)
+	defer db.Close()
+	_, err = db.Purge(0, 100)
+	checkErr(err)
+	db.SoftDeletes(true)
+
+	key := []byte("precious")
+	checkErr(db.Set(key, []byte("data")))
+	checkErr(db.Delete(key))
+	if _, err = db.Get(key); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound after soft delete, got %v", err)
+	}
+	if ok, _ := db.Has(key); ok {
+		t.Errorf("Has returned true for a soft deleted key")
+	}
+	cur, err := db.Cursor(GTE, nil)
+	checkErr(err)
+	for cur.Fetch() {
+		if bytes.Equal(key, cur.Key()) {
+			t.Errorf("Cursor returned a soft deleted key")
+		}
+	}
+	cur.Close()
+	if at, err := db.DeletedAt(key); nil != err || time.Since(at) > time.Minute {
+		t.Errorf("DeletedAt returned %v, %v", at, err)
+	}
+
+	checkErr(db.Undelete(key))
+	if v, _ := db.Get(key); "data" != string(v) {
+		t.Errorf("Expected undeleted value data, got %s", v)
+	}
+	if err = db.Undelete(key); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound undeleting twice, got %v", err)
+	}
+	checkErr(db.Delete(key))
+	checkErr(db.Set(key, []byte("new")))
+	if err = db.Undelete(key); ErrKeyExists != err {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+
+	checkErr(db.Delete(key))
+	purged, err := db.Purge(time.Hour, 100)
+	checkErr(err)
+	if 0 != purged {
+		t.Errorf("Purge within the grace period purged %d tombstones", purged)
+	}
+	if purged, err = db.Purge(-time.Hour, 100); 1 != purged {
+		t.Errorf("Expected 1 tombstone purged, got %d", purged)
+	}
+	checkErr(err)
+	if err = db.Undelete(key); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound after purge, got %v", err)
+	}
+	if _, err = db.Purge(0, 0); ErrBatchSize != err {
+		t.Errorf("Expected ErrBatchSize, got %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	open := func() *Database {
+		env, err := NewEnvironment()
+		checkErr(err)
+		checkErr(env.Dir(Create|ReadWrite, "testdb_bloom"))
+		checkErr(env.BloomFilter(BloomConfig{FalsePositiveRate: 0.01, ExpectedKeys: 1000}))
+		db, err := env.Open()
+		checkErr(err)
+		db.env = env
+		return db
+	}
+	db := open()
+	for i := 0; i < 500; i++ {
+		checkErr(db.SetSS(fmt.Sprintf("present%d", i), "v"))
+	}
+	for i := 0; i < 1000; i++ {
+		if ok, _ := db.HasS(fmt.Sprintf("absent%d", i)); ok {
+			t.Fatalf("Has returned true for an absent key")
+		}
+	}
+	stats, err := db.BloomStats()
+	checkErr(err)
+	if rate := stats.FalsePositiveRate(); 0.05 < rate || 0.05 < stats.EstimatedFalsePositiveRate {
+		t.Errorf("False positive rate %v, estimated %v", rate, stats.EstimatedFalsePositiveRate)
+	}
+	if 1000 != stats.Negatives+stats.FalsePositives {
+		t.Errorf("Expected 1000 absent lookups, got %d", stats.Negatives+stats.FalsePositives)
+	}
+	checkErr(db.Close())
+
+	// A key written while the database is opened without the filter must
+	// not be hidden by the saved filter.
+	plain, err := Open(Create, "testdb_bloom")
+	checkErr(err)
+	checkErr(plain.SetSS("unfiltered", "v"))
+	checkErr(plain.Close())
+	db = open()
+	if ok, _ := db.HasS("unfiltered"); !ok {
+		t.Errorf("Stale Bloom filter hid a key written without it")
+	}
+	checkErr(db.DeleteS("unfiltered"))
+	checkErr(db.Close())
+
+	// Opening the database read only neither removes nor saves the
+	// sidecar.
+	saved, err := os.ReadFile(bloomPath("testdb_bloom"))
+	checkErr(err)
+	env, err := NewEnvironment()
+	checkErr(err)
+	checkErr(env.Dir(ReadOnly, "testdb_bloom"))
+	checkErr(env.BloomFilter(BloomConfig{FalsePositiveRate: 0.01, ExpectedKeys: 1000}))
+	readOnly, err := env.Open()
+	checkErr(err)
+	readOnly.env = env
+	if stats, _ := readOnly.BloomStats(); 500 > stats.Keys {
+		t.Errorf("Expected the saved filter to be loaded read only, got %d keys", stats.Keys)
+	}
+	checkErr(readOnly.Close())
+	if buf, err := os.ReadFile(bloomPath("testdb_bloom")); !bytes.Equal(saved, buf) {
+		t.Errorf("Read only open changed the Bloom filter sidecar (%v)", err)
+	}
+
+	db = open()
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		if v, _ := db.GetSS(fmt.Sprintf("present%d", i)); "v" != v {
+			t.Fatalf("Key present%d missing after reopening", i)
+		}
+	}
+	stats, err = db.BloomStats()
+	checkErr(err)
+	if 500 > stats.Keys {
+		t.Errorf("Expected the saved filter to have at least 500 keys, got %d", stats.Keys)
+	}
+	checkErr(db.RebuildBloomFilter())
+	if stats, _ = db.BloomStats(); 500 > stats.Keys {
+		t.Errorf("Expected the rebuilt filter to have at least 500 keys, got %d", stats.Keys)
+	}
+}
+
+func TestCache(t *testing.T) {
+	checkErr := func(err error) {
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	db, err := Open(Create, "testdb_cache")
+	checkErr(err)
+	defer db.Close()
+	checkErr(db.SetCacheSize(64))
+	checkErr(db.SetSS("hot", "one"))
+
+	for i := 0; i < 3; i++ {
+		if v, _ := db.GetSS("hot"); "one" != v {
+			t.Errorf("Expected one, got %s", v)
+		}
+	}
+	if ok, _ := db.HasS("hot"); !ok {
+		t.Errorf("Has returned false for a cached key")
+	}
+	if stats := db.CacheStats(); 1 != stats.Misses || 3 != stats.Hits || 1 != stats.Entries {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	checkErr(db.SetSS("hot", "two"))
+	if v, _ := db.GetSS("hot"); "two" != v {
+		t.Errorf("Expected two after Set, got %s", v)
+	}
+	checkErr(db.Begin())
+	checkErr(db.SetSS("hot", "three"))
+	if v, _ := db.GetSS("hot"); "three" != v {
+		t.Errorf("Expected three in the transaction, got %s", v)
+	}
+	checkErr(db.Rollback())
+	if v, _ := db.GetSS("hot"); "two" != v {
+		t.Errorf("Expected two after Rollback, got %s", v)
+	}
+	checkErr(db.DeleteS("hot"))
+	if _, err = db.GetSS("hot"); ErrNotFound != err {
+		t.Errorf("Expected ErrNotFound after Delete, got %v", err)
+	}
+
+	// Each entry takes 19 bytes, so only three fit.
+	for i := 0; i < 5; i++ {
+		checkErr(db.SetSS(fmt.Sprintf("key%012d", i), "vvvv"))
+		db.GetSS(fmt.Sprintf("key%012d", i))
+	}
+	if stats := db.CacheStats(); 3 != stats.Entries || 57 != stats.Bytes || 64 != stats.Capacity {
+		t.Errorf("Unexpected cache stats after eviction %+v", stats)
+	}
+	checkErr(db.SetCacheSize(0))
+	if stats := db.CacheStats(); 0 != stats.Entries {
+		t.Errorf("Expected no cache, got %+v", stats)
+	}
+}
@@ -0,0 +1,327 @@
+package gophia
+
+import (
+	"errors"
+)
+
+// ErrNoPath is returned by ShortestPath when no path is found within the
+// depth bound.
+var ErrNoPath = errors.New("No path found")
+
+// Direction selects the edges followed from a node.
+type Direction int
+
+const (
+	// Outgoing follows edges from the node.
+	Outgoing Direction = iota
+	// Incoming follows edges to the node.
+	Incoming
+)
+
+// edgeFormat is the first byte of the stored value of an edge, so that
+// edges without a value are not stored with an empty value.
+const edgeFormat byte = 1
+
+// nodeFormat is the first byte of the stored value of a node, for the
+// same reason.
+const nodeFormat byte = 1
+
+// Graph is a directed graph of nodes and labeled edges stored in a
+// Database. Each edge is stored under a forward key, ordered by its
+// source node, and a reverse key, ordered by its target node, so the
+// edges in either direction of a node are read with a prefix Cursor.
+//
+// Nodes and edges are stored under system keys, so they are hidden from
+// Cursors, and node and edge values go through the ValueCodecs. Edges do
+// not require their nodes to have been set.
+type Graph struct {
+	db   *Database
+	name string
+}
+
+// Edge is a directed labeled edge of a Graph.
+type Edge struct {
+	From  []byte
+	Label string
+	To    []byte
+}
+
+// Graph returns the named Graph.
+func (db *Database) Graph(name string) *Graph {
+	return &Graph{db: db, name: name}
+}
+
+func (g *Graph) nodeKey(id []byte) []byte {
+	return sysKey("graph", g.name, "node", id)
+}
+
+// edgeKey returns the forward or reverse key of the edge.
+func (g *Graph) edgeKey(dir Direction, e Edge) []byte {
+	if Incoming == dir {
+		return sysKey("graph", g.name, "in", e.To, e.Label, e.From)
+	}
+	return sysKey("graph", g.name, "out", e.From, e.Label, e.To)
+}
+
+func init() {
+	registerSysValue("graph", func(entry []byte, parts []interface{}, _ []byte) (sysValue, bool) {
+		// Incoming edges hold no value.
+		if 3 > len(parts) || ("node" != parts[2] && "out" != parts[2]) {
+			return sysValue{}, false
+		}
+		return sysValue{key: entry}, true
+	})
+}
+
+// adjacencyPrefix returns the prefix of the keys of the edges in the
+// direction of the node, with the label if it is not empty.
+func (g *Graph) adjacencyPrefix(dir Direction, id []byte, label string) []byte {
+	parts := []interface{}{"graph", g.name, "out", id}
+	if Incoming == dir {
+		parts[2] = "in"
+	}
+	if "" != label {
+		parts = append(parts, label)
+	}
+	return sysKey(parts...)
+}
+
+// SetNode sets the value of the node.
+func (g *Graph) SetNode(id, value []byte) error {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	key := g.nodeKey(id)
+	stored, err := g.db.encodeValue(key, append([]byte{nodeFormat}, value...))
+	if nil != err {
+		return err
+	}
+	return g.db.set(key, stored)
+}
+
+// Node returns the value of the node.
+func (g *Graph) Node(id []byte) ([]byte, error) {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	key := g.nodeKey(id)
+	stored, err := g.db.get(key)
+	if nil != err {
+		return nil, err
+	}
+	value, err := g.db.decodeValue(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(value) || nodeFormat != value[0] {
+		return nil, errors.New("Invalid graph node")
+	}
+	return value[1:], nil
+}
+
+// DeleteNode deletes the node and all the edges to and from it, in a
+// single transaction.
+func (g *Graph) DeleteNode(id []byte) error {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	return g.db.update(func() error {
+		for _, dir := range []Direction{Outgoing, Incoming} {
+			err := g.db.scanRaw(nil, g.adjacencyPrefix(dir, id, ""), 1000, func(key, _ []byte) error {
+				e, err := g.parseEdge(dir, key)
+				if nil != err {
+					return err
+				}
+				if err = g.db.delete(g.edgeKey(Outgoing, e)); nil != err {
+					return err
+				}
+				return g.db.delete(g.edgeKey(Incoming, e))
+			})
+			if nil != err {
+				return err
+			}
+		}
+		return g.db.delete(g.nodeKey(id))
+	})
+}
+
+// AddEdge adds the edge from one node to another with the label, and
+// sets its value, in a single transaction.
+func (g *Graph) AddEdge(from []byte, label string, to []byte, value []byte) error {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	e := Edge{from, label, to}
+	key := g.edgeKey(Outgoing, e)
+	stored, err := g.db.encodeValue(key, append([]byte{edgeFormat}, value...))
+	if nil != err {
+		return err
+	}
+	return g.db.update(func() error {
+		if err := g.db.set(key, stored); nil != err {
+			return err
+		}
+		return g.db.set(g.edgeKey(Incoming, e), []byte{edgeFormat})
+	})
+}
+
+// EdgeValue returns the value of the edge.
+func (g *Graph) EdgeValue(from []byte, label string, to []byte) ([]byte, error) {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	key := g.edgeKey(Outgoing, Edge{from, label, to})
+	stored, err := g.db.get(key)
+	if nil != err {
+		return nil, err
+	}
+	value, err := g.db.decodeValue(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(value) || edgeFormat != value[0] {
+		return nil, errors.New("Invalid graph edge")
+	}
+	return value[1:], nil
+}
+
+// RemoveEdge removes the edge, in a single transaction.
+func (g *Graph) RemoveEdge(from []byte, label string, to []byte) error {
+	g.db.lock.Lock()
+	defer g.db.lock.Unlock()
+	e := Edge{from, label, to}
+	return g.db.update(func() error {
+		if err := g.db.delete(g.edgeKey(Outgoing, e)); nil != err {
+			return err
+		}
+		return g.db.delete(g.edgeKey(Incoming, e))
+	})
+}
+
+// parseEdge returns the edge with the forward or reverse key.
+func (g *Graph) parseEdge(dir Direction, key []byte) (Edge, error) {
+	base := sysKey("graph", g.name, "out")
+	if Incoming == dir {
+		base = sysKey("graph", g.name, "in")
+	}
+	parts, err := DecodeKey(key[len(base):])
+	if nil != err {
+		return Edge{}, err
+	}
+	if 3 != len(parts) {
+		return Edge{}, ErrInvalidKey
+	}
+	a, _ := parts[0].([]byte)
+	label, _ := parts[1].(string)
+	b, _ := parts[2].([]byte)
+	if Incoming == dir {
+		a, b = b, a
+	}
+	return Edge{a, label, b}, nil
+}
+
+// Neighbors calls fn with each edge in the direction of the node, with
+// the label, or with any label if label is empty. Edges are read with a
+// prefix Cursor in batches, and fn is called without the database lock
+// held, so it may use the database.
+func (g *Graph) Neighbors(id []byte, dir Direction, label string, fn func(e Edge) error) error {
+	const batch = 1000
+	prefix := g.adjacencyPrefix(dir, id, label)
+	from := prefix
+	var order Order = GTE
+	for {
+		g.db.lock.Lock()
+		keys, _, err := g.db.readBatch(order, from, prefix, batch)
+		g.db.lock.Unlock()
+		if nil != err {
+			return err
+		}
+		for _, key := range keys {
+			e, err := g.parseEdge(dir, key)
+			if nil != err {
+				return err
+			}
+			if err = fn(e); nil != err {
+				return err
+			}
+		}
+		if len(keys) < batch {
+			return nil
+		}
+		from, order = keys[len(keys)-1], GT
+	}
+}
+
+// next returns the node reached by following the edge in the direction.
+func (e Edge) next(dir Direction) []byte {
+	if Incoming == dir {
+		return e.From
+	}
+	return e.To
+}
+
+// BFS visits the nodes reachable from the start node by following edges
+// in the direction, with the label, or any label if label is empty, in
+// breadth-first order. fn is called with each node and its depth, the
+// start node having depth 0, up to maxDepth, which must not be negative.
+func (g *Graph) BFS(start []byte, dir Direction, label string, maxDepth int, fn func(id []byte, depth int) error) error {
+	_, err := g.bfs(start, dir, label, maxDepth, fn)
+	return err
+}
+
+// bfs visits the nodes as described by BFS, stopping early if fn returns
+// errStopScan, and returns the node each visited node was reached from.
+func (g *Graph) bfs(start []byte, dir Direction, label string, maxDepth int, fn func(id []byte, depth int) error) (map[string][]byte, error) {
+	if 0 > maxDepth {
+		return nil, errors.New("Maximum depth must not be negative")
+	}
+	parents := map[string][]byte{string(start): nil}
+	level := [][]byte{start}
+	for depth := 0; 0 < len(level); depth++ {
+		var next [][]byte
+		for _, id := range level {
+			if err := fn(id, depth); errStopScan == err {
+				return parents, nil
+			} else if nil != err {
+				return nil, err
+			}
+			if depth == maxDepth {
+				continue
+			}
+			err := g.Neighbors(id, dir, label, func(e Edge) error {
+				n := e.next(dir)
+				if _, seen := parents[string(n)]; !seen {
+					parents[string(n)] = id
+					next = append(next, n)
+				}
+				return nil
+			})
+			if nil != err {
+				return nil, err
+			}
+		}
+		level = next
+	}
+	return parents, nil
+}
+
+// ShortestPath returns the nodes of a shortest path from one node to
+// another, following edges in the direction, with the label, or any
+// label if label is empty. It returns ErrNoPath if there is no path of
+// at most maxDepth edges.
+func (g *Graph) ShortestPath(from, to []byte, dir Direction, label string, maxDepth int) ([][]byte, error) {
+	found := false
+	parents, err := g.bfs(from, dir, label, maxDepth, func(id []byte, _ int) error {
+		if string(id) == string(to) {
+			found = true
+			return errStopScan
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoPath
+	}
+	var path [][]byte
+	for id := to; nil != id; id = parents[string(id)] {
+		path = append([][]byte{id}, path...)
+	}
+	return path, nil
+}
@@ -0,0 +1,154 @@
+package gophia
+
+// write is a change to a key, passed to each writeHook.
+type write struct {
+	key []byte
+	// value is the new value of the key, and stored the value as it is
+	// stored, encoded by the ValueCodecs and with its expiry time. Both
+	// are nil if the key is deleted.
+	value, stored []byte
+	expires       int64
+	deleted       bool
+	// rewrite is true if the write only rewrites the value of the key as
+	// maintenance, such as a migration, so it is not a new version.
+	rewrite bool
+}
+
+// writeHook maintains the entries of a gophia layer, such as an index, as
+// keys are written and deleted. Hooks are called inside the transaction
+// of the write, before the key itself is changed, so they can read its
+// previous value.
+type writeHook struct {
+	// active returns true if the hook must be called with the write.
+	active func(db *Database, w *write) bool
+	// write is called with each write of a key.
+	write func(db *Database, w *write) error
+}
+
+// writeHooks are called, in order, on every write of a key through store
+// and remove. Tombstones must be taken before the deferred merges of the
+// key are discarded, since they hold the merged value.
+var writeHooks = []writeHook{
+	{func(db *Database, w *write) bool { return db.softDeletes && w.deleted }, (*Database).tombstone},
+	{func(db *Database, w *write) bool { return db.indexed() }, (*Database).reindex},
+	{func(db *Database, w *write) bool { return db.pendingMerges }, (*Database).discardMerges},
+	{func(db *Database, w *write) bool { return 0 != w.expires }, (*Database).addExpiry},
+	{func(db *Database, w *write) bool { return nil != db.versioning && !w.rewrite }, (*Database).addVersion},
+}
+
+// hooked returns true if any writeHook is active for the write.
+func (db *Database) hooked(w *write) bool {
+	for _, h := range writeHooks {
+		if h.active(db, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply makes the write, calling the active writeHooks in the same
+// transaction.
+//
+// The database lock must be held.
+func (db *Database) apply(w *write) error {
+	if 0 != w.expires && !db.expiring {
+		if err := db.enableExpiry(); nil != err {
+			return err
+		}
+	}
+	if !w.deleted {
+		stored, err := db.encodeValue(w.key, w.value)
+		if nil != err {
+			return err
+		}
+		w.stored = db.joinExpiry(w.expires, stored)
+	}
+	raw := func() error {
+		if w.deleted {
+			return db.delete(w.key)
+		}
+		return db.set(w.key, w.stored)
+	}
+	if !db.hooked(w) {
+		return raw()
+	}
+	return db.update(func() error {
+		for _, h := range writeHooks {
+			if !h.active(db, w) {
+				continue
+			}
+			if err := h.write(db, w); nil != err {
+				return err
+			}
+		}
+		return raw()
+	})
+}
+
+// rawLayer is a layer over Sophia's own reads and writes of keys, such as
+// a cache. Layers only see keys other than system keys.
+type rawLayer interface {
+	// lookup answers a read of the key without calling into Sophia, if
+	// it can, returning the value, whether the key was found, and
+	// whether the lookup was answered.
+	lookup(key []byte) ([]byte, bool, bool)
+	// loaded is called with the value of a key read from Sophia, or nil
+	// if the key was not found.
+	loaded(key, value []byte)
+	// written is called as the key is set to the value, or deleted if
+	// value is nil. tx is true if a transaction is in progress.
+	written(key, value []byte, tx bool)
+	// endTx is called as a transaction ends.
+	endTx(committed bool)
+}
+
+// resetLayers rebuilds the list of rawLayers after the cache or Bloom
+// filter has changed. The cache is consulted before the filter.
+//
+// The database lock must be held.
+func (db *Database) resetLayers() {
+	db.layers = nil
+	if nil != db.cache {
+		db.layers = append(db.layers, db.cache)
+	}
+	if nil != db.bloom {
+		db.layers = append(db.layers, db.bloom)
+	}
+}
+
+// lookup answers a read of the key from the rawLayers, if one can,
+// returning the value, whether the key was found, and whether the read
+// was answered.
+func (db *Database) lookup(key []byte) ([]byte, bool, bool) {
+	if 0 == len(db.layers) || isSysKey(key) {
+		return nil, false, false
+	}
+	for _, l := range db.layers {
+		if value, found, ok := l.lookup(key); ok {
+			return value, found, true
+		}
+	}
+	return nil, false, false
+}
+
+// loaded passes a value read from Sophia, or nil if the key was not
+// found, to the rawLayers.
+func (db *Database) loaded(key, value []byte) {
+	if 0 == len(db.layers) || isSysKey(key) {
+		return
+	}
+	for _, l := range db.layers {
+		l.loaded(key, value)
+	}
+}
+
+// written passes a write of the key to the rawLayers, before it is made.
+// value is nil if the key is deleted.
+func (db *Database) written(key, value []byte) {
+	if 0 == len(db.layers) || isSysKey(key) {
+		return
+	}
+	for _, l := range db.layers {
+		l.written(key, value, db.tx)
+	}
+}
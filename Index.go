@@ -0,0 +1,220 @@
+package gophia
+
+import (
+	"bytes"
+	"errors"
+)
+
+// IndexFunc extracts the values under which a row is indexed. It is
+// called with the key and the value as it would be returned by Get.
+// Returning no values leaves the row out of the index.
+type IndexFunc func(key, value []byte) [][]byte
+
+// ErrUnknownIndex is returned when using an index that has not been
+// added to the database.
+var ErrUnknownIndex = errors.New("Index not found")
+
+// ObjectIndex returns an IndexFunc for rows holding gob encoded objects,
+// as stored by SetAO, decoding each object as a T before calling
+// extract. Rows that cannot be decoded as a T are not indexed.
+func ObjectIndex[T any](extract func(key []byte, obj T) [][]byte) IndexFunc {
+	return func(key, value []byte) [][]byte {
+		var obj T
+		if err := decodeObject(value, &obj); nil != err {
+			return nil
+		}
+		return extract(key, obj)
+	}
+}
+
+// AddIndex adds a secondary index to the database. Once added, index
+// entries are maintained in the same transaction as every Set and Delete.
+//
+// Indexes are not stored with the database, so they must be added each
+// time the database is opened. Rows written while the index was not
+// added are only indexed by RebuildIndex.
+func (db *Database) AddIndex(name string, extract IndexFunc) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.indexes {
+		db.indexes = map[string]IndexFunc{}
+	}
+	db.indexes[name] = extract
+}
+
+// RebuildIndex removes every entry in the named index or text index,
+// and re-indexes every row in the database.
+func (db *Database) RebuildIndex(name string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.textIndexes[name]; ok {
+		return db.rebuildTextIndex(name)
+	}
+	extract, ok := db.indexes[name]
+	if !ok {
+		return ErrUnknownIndex
+	}
+	err := db.scanRaw(nil, sysKey("index", name), 1000, func(key, _ []byte) error {
+		return db.delete(key)
+	})
+	if nil != err {
+		return err
+	}
+	return db.scanRaw(nil, nil, 1000, func(key, stored []byte) error {
+		value, _, err := db.decodeStored(key, stored)
+		if nil != err {
+			return err
+		}
+		for _, v := range extract(key, value) {
+			if err = db.set(indexKey(name, v, key), key); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LookupByIndex returns the keys of the rows indexed under the value in
+// the named index.
+func (db *Database) LookupByIndex(name string, value []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := db.scanIndex(name, nil, sysKey("index", name, value), nil, func(_, key []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// ScanIndex calls fn with each index value and key in the named index,
+// in index value order, for index values from start (inclusive) to end
+// (exclusive). A nil start scans from the first index value, and a nil
+// end scans to the last.
+//
+// No Cursor is held open while fn is called, so fn may read and write the
+// database.
+func (db *Database) ScanIndex(name string, start, end []byte, fn func(value, key []byte) error) error {
+	var from []byte
+	if nil != start {
+		from = sysKey("index", name, start)
+	}
+	inRange := func(value []byte) bool {
+		return nil == end || 0 > bytes.Compare(value, end)
+	}
+	return db.scanIndex(name, from, sysKey("index", name), inRange, fn)
+}
+
+// scanIndex calls fn for the entries of the named index with the
+// prefix, starting from the entry key from, while inRange returns true
+// for their index value. The entries are read in batches, and fn is
+// called without the database lock held.
+func (db *Database) scanIndex(name string, from, prefix []byte, inRange func(value []byte) bool, fn func(value, key []byte) error) error {
+	const batch = 1000
+	if !db.hasIndex(name) {
+		return ErrUnknownIndex
+	}
+	if nil == from {
+		from = prefix
+	}
+	base := len(sysKey("index", name))
+	var order Order = GTE
+	for {
+		db.lock.Lock()
+		entries, keys, err := db.readBatch(order, from, prefix, batch)
+		db.lock.Unlock()
+		if nil != err {
+			return err
+		}
+		for i, entry := range entries {
+			value, _, err := decodeKeyPart(entry[base:])
+			if nil != err {
+				return err
+			}
+			if nil != inRange && !inRange(value.([]byte)) {
+				return nil
+			}
+			if err = fn(value.([]byte), keys[i]); nil != err {
+				return err
+			}
+		}
+		if len(entries) < batch {
+			return nil
+		}
+		from, order = entries[len(entries)-1], GT
+	}
+}
+
+// hasIndex returns true if the database has the named index.
+func (db *Database) hasIndex(name string) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	_, ok := db.indexes[name]
+	return ok
+}
+
+// indexKey returns the key of the entry for the row key under the value
+// in the named index.
+func indexKey(name string, value, key []byte) []byte {
+	return sysKey("index", name, value, key)
+}
+
+// indexed returns true if the database has any indexes or text indexes
+// to maintain.
+func (db *Database) indexed() bool {
+	return 0 < len(db.indexes) || 0 < len(db.textIndexes)
+}
+
+// index adds the index entries for the row.
+func (db *Database) index(key, value []byte) error {
+	for name, extract := range db.indexes {
+		for _, v := range extract(key, value) {
+			if err := db.set(indexKey(name, v, key), key); nil != err {
+				return err
+			}
+		}
+	}
+	for name := range db.textIndexes {
+		if err := db.textIndex(name, key, value); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex is the writeHook that replaces the index entries of the row
+// stored under a key with those of the value written.
+//
+// The database lock must be held, inside a transaction.
+func (db *Database) reindex(w *write) error {
+	if err := db.unindex(w.key); nil != err {
+		return err
+	}
+	if w.deleted {
+		return nil
+	}
+	return db.index(w.key, w.value)
+}
+
+// unindex removes the index entries for the row currently stored under
+// the key, if there is one.
+func (db *Database) unindex(key []byte) error {
+	old, _, err := db.load(key)
+	if ErrNotFound == err {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	for name, extract := range db.indexes {
+		for _, v := range extract(key, old) {
+			if err = db.delete(indexKey(name, v, key)); nil != err {
+				return err
+			}
+		}
+	}
+	for name := range db.textIndexes {
+		if err = db.textUnindex(name, key, old); nil != err {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Type codes for the parts of an encoded key. The codes order parts of
+// different types relative to each other.
+const (
+	keyBytes  byte = 0x01
+	keyString byte = 0x02
+	keyInt    byte = 0x03
+	keyUint   byte = 0x04
+	keyFloat  byte = 0x05
+	keyFalse  byte = 0x06
+	keyTrue   byte = 0x07
+)
+
+// ErrInvalidKey is returned when decoding a key that was not created
+// with EncodeKey.
+var ErrInvalidKey = errors.New("Invalid encoded key")
+
+// EncodeKey encodes the parts into a single key whose bytewise ordering
+// matches the natural ordering of the parts, compared in sequence.
+//
+// Parts may be strings, byte slices, booleans, any integer or float type,
+// any type defined on one of these, such as type UserID int64, or a
+// time.Time. Signed integers and times are decoded as int64,
+// unsigned integers as uint64 and floats as float64.
+//
+// The encoding of a sequence of parts is a prefix of the encoding of any
+// longer sequence that starts with the same parts, so encoded keys can
+// be scanned by prefix.
+func EncodeKey(parts ...interface{}) ([]byte, error) {
+	var key []byte
+	var err error
+	for _, p := range parts {
+		key, err = appendKeyPart(key, p)
+		if nil != err {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// MustEncodeKey is like EncodeKey, but panics on error.
+func MustEncodeKey(parts ...interface{}) []byte {
+	key, err := EncodeKey(parts...)
+	if nil != err {
+		panic(err)
+	}
+	return key
+}
+
+// DecodeKey decodes a key created with EncodeKey into its parts.
+func DecodeKey(key []byte) ([]interface{}, error) {
+	var parts []interface{}
+	for 0 < len(key) {
+		var p interface{}
+		var err error
+		p, key, err = decodeKeyPart(key)
+		if nil != err {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// appendKeyPart appends the order-preserving encoding of p to key.
+func appendKeyPart(key []byte, p interface{}) ([]byte, error) {
+	if t, ok := p.(time.Time); ok {
+		return appendKeyInt(key, t.UnixNano()), nil
+	}
+	// Switching on the kind also accepts named types, such as
+	// type UserID int64.
+	v := reflect.ValueOf(p)
+	switch v.Kind() {
+	case reflect.Slice:
+		if reflect.Uint8 == v.Type().Elem().Kind() {
+			return appendKeyEscaped(append(key, keyBytes), v.Bytes()), nil
+		}
+	case reflect.String:
+		return appendKeyEscaped(append(key, keyString), []byte(v.String())), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(key, keyTrue), nil
+		}
+		return append(key, keyFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendKeyInt(key, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendKeyUint(key, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return appendKeyFloat(key, v.Float()), nil
+	}
+	return nil, fmt.Errorf("Cannot encode key part of type %T", p)
+}
+
+// appendKeyEscaped appends b with each 0x00 escaped as 0x00 0xff,
+// followed by a 0x00 terminator.
+func appendKeyEscaped(key, b []byte) []byte {
+	for _, c := range b {
+		key = append(key, c)
+		if 0 == c {
+			key = append(key, 0xff)
+		}
+	}
+	return append(key, 0)
+}
+
+// appendKeyInt appends v big-endian with the sign bit flipped, so that
+// negative values order before positive values.
+func appendKeyInt(key []byte, v int64) []byte {
+	key = append(key, keyInt)
+	return binary.BigEndian.AppendUint64(key, uint64(v)^(1<<63))
+}
+
+func appendKeyUint(key []byte, v uint64) []byte {
+	key = append(key, keyUint)
+	return binary.BigEndian.AppendUint64(key, v)
+}
+
+// appendKeyFloat appends the IEEE bits of v, with all bits inverted for
+// negative values and only the sign bit flipped for positive values.
+func appendKeyFloat(key []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if 0 != bits&(1<<63) {
+		bits = ^bits
+	} else {
+		bits ^= 1 << 63
+	}
+	key = append(key, keyFloat)
+	return binary.BigEndian.AppendUint64(key, bits)
+}
+
+// decodeKeyPart decodes the first part of key, returning it and the
+// remainder of the key.
+func decodeKeyPart(key []byte) (interface{}, []byte, error) {
+	switch key[0] {
+	case keyBytes, keyString:
+		var b []byte
+		for i := 1; i < len(key); i++ {
+			if 0 != key[i] {
+				b = append(b, key[i])
+				continue
+			}
+			if i+1 < len(key) && 0xff == key[i+1] {
+				b = append(b, 0)
+				i++
+				continue
+			}
+			if keyString == key[0] {
+				return string(b), key[i+1:], nil
+			}
+			if nil == b {
+				b = []byte{}
+			}
+			return b, key[i+1:], nil
+		}
+	case keyInt, keyUint, keyFloat:
+		if len(key) < 9 {
+			break
+		}
+		bits := binary.BigEndian.Uint64(key[1:9])
+		switch key[0] {
+		case keyInt:
+			return int64(bits ^ (1 << 63)), key[9:], nil
+		case keyUint:
+			return bits, key[9:], nil
+		}
+		if 0 != bits&(1<<63) {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), key[9:], nil
+	case keyFalse:
+		return false, key[1:], nil
+	case keyTrue:
+		return true, key[1:], nil
+	}
+	return nil, nil, ErrInvalidKey
+}
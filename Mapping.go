@@ -0,0 +1,123 @@
+package gophia
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ErrNotStruct is returned when an object passed to Put, Load or Remove
+// is not a struct or a pointer to a struct.
+var ErrNotStruct = errors.New("Object is not a struct or pointer to struct")
+
+// ErrNoKeyFields is returned when a struct has no fields tagged as key
+// fields.
+var ErrNoKeyFields = errors.New("Struct has no `gophia:\"key\"` fields")
+
+// ErrUnnamedStruct is returned when an object passed to Put, Load or
+// Remove is an anonymous struct, which has no type name for its key.
+var ErrUnnamedStruct = errors.New("Struct type has no name")
+
+// mappings caches the key fields of each struct type.
+var mappings sync.Map
+
+// mapping describes how the key for a struct type is derived.
+type mapping struct {
+	name   string
+	fields [][]int
+}
+
+// mappingFor returns the mapping for the struct type t, building it the
+// first time the type is seen.
+func mappingFor(t reflect.Type) (*mapping, error) {
+	if m, ok := mappings.Load(t); ok {
+		return m.(*mapping), nil
+	}
+	if "" == t.Name() {
+		return nil, ErrUnnamedStruct
+	}
+	// The package path keeps types of the same name in different
+	// packages apart.
+	m := &mapping{name: t.PkgPath() + "." + t.Name()}
+	for _, f := range reflect.VisibleFields(t) {
+		for _, opt := range strings.Split(f.Tag.Get("gophia"), ",") {
+			if "key" == opt {
+				if !f.IsExported() {
+					return nil, fmt.Errorf("Key field %s of %s is not exported", f.Name, m.name)
+				}
+				m.fields = append(m.fields, f.Index)
+				break
+			}
+		}
+	}
+	if 0 == len(m.fields) {
+		return nil, ErrNoKeyFields
+	}
+	mappings.Store(t, m)
+	return m, nil
+}
+
+// KeyOf returns the key under which Put stores the object. The key is
+// the EncodeKey encoding of the struct's package path and type name, as
+// in "example.com/bank.Account", followed by each of the fields tagged
+// `gophia:"key"` in the order they are declared. Key fields must be
+// exported.
+func KeyOf(obj interface{}) ([]byte, error) {
+	v := reflect.ValueOf(obj)
+	for reflect.Ptr == v.Kind() {
+		v = v.Elem()
+	}
+	if reflect.Struct != v.Kind() {
+		return nil, ErrNotStruct
+	}
+	m, err := mappingFor(v.Type())
+	if nil != err {
+		return nil, err
+	}
+	key, err := appendKeyPart(nil, m.name)
+	if nil != err {
+		return nil, err
+	}
+	for _, index := range m.fields {
+		key, err = appendKeyPart(key, v.FieldByIndex(index).Interface())
+		if nil != err {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Put gob encodes the object and stores it under the key derived from
+// its `gophia:"key"` fields.
+func (db *Database) Put(obj interface{}) error {
+	key, err := KeyOf(obj)
+	if nil != err {
+		return err
+	}
+	return db.SetAO(key, obj)
+}
+
+// Load retrieves the object whose key fields are set on obj, which must
+// be a pointer to a struct.
+func (db *Database) Load(obj interface{}) error {
+	if reflect.Ptr != reflect.ValueOf(obj).Kind() {
+		return ErrNotStruct
+	}
+	key, err := KeyOf(obj)
+	if nil != err {
+		return err
+	}
+	return db.GetAO(key, obj)
+}
+
+// Remove deletes the object stored under the key derived from its
+// `gophia:"key"` fields.
+func (db *Database) Remove(obj interface{}) error {
+	key, err := KeyOf(obj)
+	if nil != err {
+		return err
+	}
+	return db.Delete(key)
+}
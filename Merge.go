@@ -0,0 +1,375 @@
+package gophia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MergeFunc combines the current value of a key with an operand, and
+// returns the new value. The current value is nil if the key does not
+// exist.
+type MergeFunc func(current, operand []byte) ([]byte, error)
+
+// ErrNoMergeOperator is returned by Merge when no merge operator applies
+// to the key.
+var ErrNoMergeOperator = errors.New("No merge operator for key")
+
+var (
+	mergeFuncsLock sync.RWMutex
+	mergeFuncs     = map[string]MergeFunc{
+		"append": mergeAppend,
+		"sum":    mergeSum,
+		"max":    mergeMax,
+		"union":  mergeUnion,
+	}
+)
+
+// RegisterMergeFunc registers a named MergeFunc. The built-in functions
+// are:
+//
+//	append: appends the operand to the value.
+//	sum:    adds an 8 byte big-endian int64 operand to an int64 counter,
+//	        as read by Counter.
+//	max:    keeps the bytewise greater of the value and the operand.
+//	union:  adds the members of an EncodeSet operand to an EncodeSet
+//	        value.
+func RegisterMergeFunc(name string, fn MergeFunc) {
+	mergeFuncsLock.Lock()
+	defer mergeFuncsLock.Unlock()
+	mergeFuncs[name] = fn
+}
+
+// mergeFunc returns the named MergeFunc, or nil if there is none.
+func mergeFunc(name string) MergeFunc {
+	mergeFuncsLock.RLock()
+	defer mergeFuncsLock.RUnlock()
+	return mergeFuncs[name]
+}
+
+// mergeOperator applies the named MergeFunc to keys with the prefix.
+type mergeOperator struct {
+	prefix []byte
+	name   string
+}
+
+// MergeOperator sets the named MergeFunc as the merge operator for keys
+// with the prefix. Where the prefixes of several operators match a key,
+// the longest prefix wins.
+//
+// Merge operators are not stored with the database, so they must be set
+// each time the database is opened.
+func (db *Database) MergeOperator(prefix []byte, name string) error {
+	if nil == mergeFunc(name) {
+		return fmt.Errorf("Merge function %q is not registered", name)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.mergeOps = append(db.mergeOps, mergeOperator{append([]byte{}, prefix...), name})
+	return nil
+}
+
+// DeferMerges sets whether Merge applies operands immediately, or stores
+// them to be applied later. Deferred operands are applied when the key
+// is read with Get, or when CompactMerges is called, but Cursors do not
+// see them. Any other write to the key discards its deferred operands.
+//
+// Deferred operands are found with range scans, so DeferMerges returns
+// ErrKeyOrder in a database with a custom key order.
+func (db *Database) DeferMerges(deferred bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if deferred && customOrder == db.order {
+		return ErrKeyOrder
+	}
+	db.deferMerges = deferred
+	return nil
+}
+
+// operatorFor returns the name of the merge operator for the key.
+func (db *Database) operatorFor(key []byte) (string, error) {
+	best := -1
+	for i, op := range db.mergeOps {
+		if bytes.HasPrefix(key, op.prefix) && (0 > best || len(op.prefix) > len(db.mergeOps[best].prefix)) {
+			best = i
+		}
+	}
+	if 0 > best {
+		return "", ErrNoMergeOperator
+	}
+	return db.mergeOps[best].name, nil
+}
+
+// Merge atomically applies the merge operator for the key to the key's
+// value and the operand. If merges are deferred, the operand is stored
+// to be applied later.
+func (db *Database) Merge(key, operand []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	name, err := db.operatorFor(key)
+	if nil != err {
+		return err
+	}
+	if db.deferMerges {
+		return db.deferMerge(key, name, operand)
+	}
+	return db.update(func() error {
+		value, expires, _, err := db.merged(key)
+		if nil != err {
+			return err
+		}
+		if value, err = mergeFunc(name)(value, operand); nil != err {
+			return err
+		}
+		return db.storeMerged(&write{key: key, value: value, expires: expires})
+	})
+}
+
+// storeMerged makes the write of the merged value of a key. An empty
+// merged value deletes the key, since Sophia cannot store empty values.
+//
+// The database lock must be held.
+func (db *Database) storeMerged(w *write) error {
+	if 0 == len(w.value) {
+		w.value, w.expires, w.deleted = nil, 0, true
+	}
+	return db.apply(w)
+}
+
+// mergeKey returns the system key for a deferred operand of the key.
+// The sequence number orders the operands of the key.
+func mergeKey(key []byte, seq uint64) []byte {
+	return sysKey("merge", key, seq)
+}
+
+func init() {
+	registerSysValue("merge", wholeSysValue)
+}
+
+// deferMerge stores the operand of the named MergeFunc for the key, to be
+// applied later. The stored operand is the uvarint length of the name,
+// the name and the operand, through the ValueCodecs.
+func (db *Database) deferMerge(key []byte, name string, operand []byte) error {
+	if customOrder == db.order {
+		return ErrKeyOrder
+	}
+	db.mergeSeq++
+	entry := mergeKey(key, db.mergeSeq)
+	payload := binary.AppendUvarint(nil, uint64(len(name)))
+	payload = append(append(payload, name...), operand...)
+	payload, err := db.encodeValue(entry, payload)
+	if nil != err {
+		return err
+	}
+	db.pendingMerges = true
+	return db.set(entry, payload)
+}
+
+// merged returns the value of the key with any deferred operands applied,
+// its expiry time, and whether the key exists. Keys that have expired do
+// not exist, and have no expiry time.
+func (db *Database) merged(key []byte) ([]byte, int64, bool, error) {
+	value, expires, err := db.load(key)
+	exists := nil == err && !expired(expires)
+	if ErrNotFound == err {
+		err = nil
+	}
+	if nil != err {
+		return nil, 0, false, err
+	}
+	if !exists {
+		value, expires = nil, 0
+	}
+	if !db.pendingMerges {
+		return value, expires, exists, nil
+	}
+	err = db.scanRaw(nil, sysKey("merge", key), 100, func(entry, payload []byte) error {
+		payload, err := db.decodeValue(entry, payload)
+		if nil != err {
+			return err
+		}
+		n, size := binary.Uvarint(payload)
+		if 0 >= size || uint64(len(payload)-size) < n {
+			return errors.New("Invalid deferred merge operand")
+		}
+		name, operand := string(payload[size:size+int(n)]), payload[size+int(n):]
+		fn := mergeFunc(name)
+		if nil == fn {
+			return fmt.Errorf("Merge function %q is not registered", name)
+		}
+		value, err = fn(value, operand)
+		exists = true
+		return err
+	})
+	if nil != err {
+		return nil, 0, false, err
+	}
+	// An empty merged value deletes the key, as storeMerged does.
+	if 0 == len(value) {
+		return nil, 0, false, nil
+	}
+	return value, expires, exists, nil
+}
+
+// discardMerges deletes the deferred operands of the key.
+func (db *Database) discardMerges(w *write) error {
+	return db.scanRaw(nil, sysKey("merge", w.key), 1000, func(entry, _ []byte) error {
+		return db.delete(entry)
+	})
+}
+
+// loadMerges finds whether the database holds any deferred merge
+// operands, and continues their sequence numbers from the highest one
+// stored. A database with a custom key order cannot apply deferred
+// operands, so loadMerges returns ErrKeyOrder if it holds any.
+func (db *Database) loadMerges() error {
+	prefix := sysKey("merge")
+	if customOrder == db.order {
+		// Operands cannot be found with a range scan, so walk every key.
+		cur, err := db.cursor(GTE, nil)
+		if nil != err {
+			return err
+		}
+		defer cur.close()
+		cur.raw = true
+		for cur.Fetch() {
+			if bytes.HasPrefix(cur.Key(), prefix) {
+				return ErrKeyOrder
+			}
+		}
+		return nil
+	}
+	return db.scanRaw(nil, prefix, 1000, func(entry, _ []byte) error {
+		_, rest, err := decodeKeyPart(entry[len(prefix):])
+		if nil != err {
+			return err
+		}
+		part, _, err := decodeKeyPart(rest)
+		if nil != err {
+			return err
+		}
+		seq, ok := part.(uint64)
+		if !ok {
+			return errors.New("Invalid deferred merge key")
+		}
+		db.pendingMerges = true
+		if seq > db.mergeSeq {
+			db.mergeSeq = seq
+		}
+		return nil
+	})
+}
+
+// CompactMerges applies all deferred merge operands to their keys, and
+// returns the number of keys updated. Each key is updated in its own
+// transaction.
+func (db *Database) CompactMerges() (int, error) {
+	prefix := sysKey("merge")
+	count := 0
+	for {
+		db.lock.Lock()
+		entries, _, err := db.readBatch(GTE, prefix, prefix, 1)
+		if nil == err && 0 == len(entries) {
+			db.pendingMerges = false
+		}
+		if nil != err || 0 == len(entries) {
+			db.lock.Unlock()
+			return count, err
+		}
+		key, _, err := decodeKeyPart(entries[0][len(prefix):])
+		if nil == err {
+			err = db.update(func() error {
+				value, expires, _, err := db.merged(key.([]byte))
+				if nil != err {
+					return err
+				}
+				// Storing the value discards the operands just applied.
+				// Compaction only rewrites the value, so it adds no
+				// version.
+				return db.storeMerged(&write{key: key.([]byte), value: value, expires: expires, rewrite: true})
+			})
+		}
+		db.lock.Unlock()
+		if nil != err {
+			return count, err
+		}
+		count++
+	}
+}
+
+func mergeAppend(current, operand []byte) ([]byte, error) {
+	return append(append([]byte{}, current...), operand...), nil
+}
+
+func mergeSum(current, operand []byte) ([]byte, error) {
+	if 8 != len(operand) {
+		return nil, errors.New("Sum operand must be an 8 byte int64")
+	}
+	var n uint64
+	if nil != current {
+		var err error
+		if n, err = decodeCounter(counterInt, current); nil != err {
+			return nil, err
+		}
+	}
+	return encodeCounter(counterInt, n+binary.BigEndian.Uint64(operand)), nil
+}
+
+func mergeMax(current, operand []byte) ([]byte, error) {
+	if nil != current && 0 <= bytes.Compare(current, operand) {
+		return current, nil
+	}
+	return operand, nil
+}
+
+func mergeUnion(current, operand []byte) ([]byte, error) {
+	a, err := DecodeSet(current)
+	if nil != err {
+		return nil, err
+	}
+	b, err := DecodeSet(operand)
+	if nil != err {
+		return nil, err
+	}
+	return EncodeSet(append(a, b...)...), nil
+}
+
+// EncodeSet encodes the members as a sorted set without duplicates, as
+// used by the union merge function.
+func EncodeSet(members ...[]byte) []byte {
+	sorted := make([][]byte, len(members))
+	copy(sorted, members)
+	sort.Slice(sorted, func(i, j int) bool {
+		return 0 > bytes.Compare(sorted[i], sorted[j])
+	})
+	set := []byte{}
+	for i, m := range sorted {
+		if 0 < i && bytes.Equal(m, sorted[i-1]) {
+			continue
+		}
+		set, _ = appendKeyPart(set, m)
+	}
+	return set
+}
+
+// DecodeSet returns the members of a set encoded with EncodeSet, in
+// order.
+func DecodeSet(set []byte) ([][]byte, error) {
+	var members [][]byte
+	for 0 < len(set) {
+		m, rest, err := decodeKeyPart(set)
+		if nil != err {
+			return nil, err
+		}
+		b, ok := m.([]byte)
+		if !ok {
+			return nil, ErrInvalidKey
+		}
+		members = append(members, b)
+		set = rest
+	}
+	return members, nil
+}
@@ -0,0 +1,341 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrQueueEmpty is returned when reading from a Queue with no visible
+// messages.
+var ErrQueueEmpty = errors.New("Queue is empty")
+
+// messageFormat is the first byte of the value of a message, so that
+// empty messages are not stored with an empty value.
+const messageFormat byte = 1
+
+// ErrLeaseExpired is returned when acknowledging a Message whose
+// visibility timeout has passed, so that it has returned to the Queue.
+var ErrLeaseExpired = errors.New("Message lease has expired")
+
+// Queue is a durable first-in first-out queue stored in a Database.
+//
+// Messages are stored under sequence-numbered system keys in the
+// Queue's namespace, so they are hidden from Cursors. Each operation
+// runs in its own transaction, or joins the transaction in progress.
+type Queue struct {
+	db   *Database
+	name string
+	// head is no greater than the sequence number of the first ready
+	// message, and tail is the sequence number of the next message
+	// pushed. Both are protected by the database lock.
+	head, tail uint64
+}
+
+// Message is a message reserved from a Queue.
+type Message struct {
+	ID    uint64
+	Value []byte
+	// lease is the key of the message while it is reserved.
+	lease []byte
+}
+
+// Queue returns the named Queue, recovering its head and tail from the
+// database the first time it is opened.
+func (db *Database) Queue(name string) (*Queue, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if q, ok := db.queues[name]; ok {
+		return q, nil
+	}
+	q := &Queue{db: db, name: name}
+	if err := q.recover(); nil != err {
+		return nil, err
+	}
+	if nil == db.queues {
+		db.queues = make(map[string]*Queue)
+	}
+	db.queues[name] = q
+	return q, nil
+}
+
+// readyPrefix returns the prefix of the keys of the ready messages.
+func (q *Queue) readyPrefix() []byte {
+	return sysKey("queue", q.name, "ready")
+}
+
+// readyKey returns the key of the ready message with the sequence number.
+func (q *Queue) readyKey(seq uint64) []byte {
+	return sysKey("queue", q.name, "ready", seq)
+}
+
+// leasedPrefix returns the prefix of the keys of the reserved messages.
+func (q *Queue) leasedPrefix() []byte {
+	return sysKey("queue", q.name, "leased")
+}
+
+// leasedKey returns the key of the reserved message with the sequence
+// number, which becomes visible again at the deadline.
+func (q *Queue) leasedKey(deadline int64, seq uint64) []byte {
+	return sysKey("queue", q.name, "leased", deadline, seq)
+}
+
+// tailKey returns the key recording the tail of the Queue, so that
+// sequence numbers are never reused, even once the Queue is drained.
+func (q *Queue) tailKey() []byte {
+	return sysKey("queue", q.name, "tail")
+}
+
+func init() {
+	registerSysValue("queue", func(entry []byte, parts []interface{}, _ []byte) (sysValue, bool) {
+		switch {
+		case 4 == len(parts) && "ready" == parts[2]:
+			return sysValue{key: entry}, true
+		case 5 == len(parts) && "leased" == parts[2]:
+			// Reserved messages keep the encoding of their ready key.
+			return sysValue{key: sysKey("queue", parts[1], "ready", parts[4])}, true
+		}
+		return sysValue{}, false
+	})
+}
+
+// recover reads the Queue's tail, and scans its keys for its head.
+func (q *Queue) recover() error {
+	buf, err := q.db.get(q.tailKey())
+	switch {
+	case nil == err && 8 == len(buf):
+		q.tail = binary.BigEndian.Uint64(buf)
+	case nil == err:
+		return errors.New("Invalid queue tail")
+	case ErrNotFound != err:
+		return err
+	}
+	prefix := q.readyPrefix()
+	keys, _, err := q.db.readBatch(GTE, prefix, prefix, 1)
+	if nil != err {
+		return err
+	}
+	if 0 < len(keys) {
+		if q.head, err = q.seq(keys[0], prefix); nil != err {
+			return err
+		}
+		// Find the last ready message by reading backwards from the end
+		// of the prefix.
+		end := append([]byte{}, prefix...)
+		end[len(end)-1]++
+		if keys, _, err = q.db.readBatch(LT, end, prefix, 1); nil != err {
+			return err
+		}
+		last, err := q.seq(keys[0], prefix)
+		if nil != err {
+			return err
+		}
+		if last >= q.tail {
+			q.tail = last + 1
+		}
+	}
+	// Reserved messages are ordered by deadline, so all of them must be
+	// read to find the greatest sequence number.
+	return q.db.scanRaw(nil, q.leasedPrefix(), 1000, func(key, _ []byte) error {
+		seq, err := q.leasedSeq(key)
+		if nil == err && seq >= q.tail {
+			q.tail = seq + 1
+		}
+		return err
+	})
+}
+
+// seq returns the sequence number of the ready key with the prefix.
+func (q *Queue) seq(key, prefix []byte) (uint64, error) {
+	seq, _, err := decodeKeyPart(key[len(prefix):])
+	if nil != err {
+		return 0, err
+	}
+	return seq.(uint64), nil
+}
+
+// leasedSeq returns the sequence number of the leased key.
+func (q *Queue) leasedSeq(key []byte) (uint64, error) {
+	_, rest, err := decodeKeyPart(key[len(q.leasedPrefix()):])
+	if nil != err {
+		return 0, err
+	}
+	return q.seq(rest, nil)
+}
+
+// Push adds the value to the tail of the Queue, and returns its
+// sequence number.
+func (q *Queue) Push(value []byte) (uint64, error) {
+	q.db.lock.Lock()
+	defer q.db.lock.Unlock()
+	seq := q.tail
+	key := q.readyKey(seq)
+	stored, err := q.db.encodeValue(key, append([]byte{messageFormat}, value...))
+	if nil != err {
+		return 0, err
+	}
+	err = q.db.update(func() error {
+		if err := q.db.set(key, stored); nil != err {
+			return err
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, seq+1)
+		return q.db.set(q.tailKey(), buf)
+	})
+	if nil != err {
+		return 0, err
+	}
+	q.tail++
+	return seq, nil
+}
+
+// decode returns the message stored under the ready key.
+func (q *Queue) decode(key, stored []byte) ([]byte, error) {
+	value, err := q.db.decodeValue(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(value) || messageFormat != value[0] {
+		return nil, errors.New("Invalid queue message")
+	}
+	return value[1:], nil
+}
+
+// first returns the key, sequence number and stored value of the message
+// at the head of the Queue, after returning any reserved messages whose
+// visibility timeout has passed.
+func (q *Queue) first() ([]byte, uint64, []byte, error) {
+	if err := q.requeue(); nil != err {
+		return nil, 0, nil, err
+	}
+	prefix := q.readyPrefix()
+	keys, values, err := q.db.readBatch(GTE, q.readyKey(q.head), prefix, 1)
+	if nil != err {
+		return nil, 0, nil, err
+	}
+	if 0 == len(keys) {
+		return nil, 0, nil, ErrQueueEmpty
+	}
+	seq, err := q.seq(keys[0], prefix)
+	if nil != err {
+		return nil, 0, nil, err
+	}
+	q.head = seq
+	return keys[0], seq, values[0], nil
+}
+
+// requeue returns the reserved messages whose visibility timeout has
+// passed to the Queue, in their original positions.
+func (q *Queue) requeue() error {
+	prefix := q.leasedPrefix()
+	now := time.Now().UnixNano()
+	for {
+		keys, values, err := q.db.readBatch(GTE, prefix, prefix, 100)
+		if nil != err || 0 == len(keys) {
+			return err
+		}
+		for i, key := range keys {
+			deadline, rest, err := decodeKeyPart(key[len(prefix):])
+			if nil != err {
+				return err
+			}
+			if deadline.(int64) > now {
+				return nil
+			}
+			seq, err := q.seq(rest, nil)
+			if nil != err {
+				return err
+			}
+			err = q.db.update(func() error {
+				if err := q.db.delete(key); nil != err {
+					return err
+				}
+				return q.db.set(q.readyKey(seq), values[i])
+			})
+			if nil != err {
+				return err
+			}
+			if seq < q.head {
+				q.head = seq
+			}
+		}
+	}
+}
+
+// Peek returns the value at the head of the Queue without removing it.
+func (q *Queue) Peek() ([]byte, error) {
+	q.db.lock.Lock()
+	defer q.db.lock.Unlock()
+	key, _, stored, err := q.first()
+	if nil != err {
+		return nil, err
+	}
+	return q.decode(key, stored)
+}
+
+// Pop removes and returns the value at the head of the Queue.
+func (q *Queue) Pop() ([]byte, error) {
+	q.db.lock.Lock()
+	defer q.db.lock.Unlock()
+	key, _, stored, err := q.first()
+	if nil != err {
+		return nil, err
+	}
+	value, err := q.decode(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	return value, q.db.delete(key)
+}
+
+// Reserve removes the message at the head of the Queue for the
+// visibility timeout. The message must be acknowledged with Ack before
+// the timeout passes, or it returns to its place in the Queue to be
+// delivered again.
+func (q *Queue) Reserve(visibility time.Duration) (*Message, error) {
+	q.db.lock.Lock()
+	defer q.db.lock.Unlock()
+	key, seq, stored, err := q.first()
+	if nil != err {
+		return nil, err
+	}
+	value, err := q.decode(key, stored)
+	if nil != err {
+		return nil, err
+	}
+	m := &Message{ID: seq, Value: value, lease: q.leasedKey(time.Now().Add(visibility).UnixNano(), seq)}
+	err = q.db.update(func() error {
+		if err := q.db.delete(key); nil != err {
+			return err
+		}
+		// The stored value is moved as it is: it was encoded with the
+		// ready key, which requeue restores.
+		return q.db.set(m.lease, stored)
+	})
+	if nil != err {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Ack acknowledges a reserved Message, removing it from the Queue. It
+// returns ErrLeaseExpired if the Message's visibility timeout has passed.
+func (q *Queue) Ack(m *Message) error {
+	q.db.lock.Lock()
+	defer q.db.lock.Unlock()
+	// The deadline is the first part of the lease after the prefix.
+	deadline, _, err := decodeKeyPart(m.lease[len(q.leasedPrefix()):])
+	if nil != err {
+		return err
+	}
+	if deadline.(int64) <= time.Now().UnixNano() {
+		return ErrLeaseExpired
+	}
+	if _, err := q.db.get(m.lease); nil != err {
+		if ErrNotFound == err {
+			return ErrLeaseExpired
+		}
+		return err
+	}
+	return q.db.delete(m.lease)
+}
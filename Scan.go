@@ -0,0 +1,120 @@
+package gophia
+
+import (
+	"bytes"
+	"errors"
+)
+
+// errStopScan is returned by the function called by scanRaw to end the
+// scan early without an error.
+var errStopScan = errors.New("Stop scan")
+
+// ErrKeyOrder is returned by the features that scan ranges of keys, such
+// as indexes and the expiry sweeper, in a database whose KeyComparator
+// orders keys other than bytewise, or bytewise in reverse.
+var ErrKeyOrder = errors.New("Key order does not support range scans")
+
+// keyOrder is how a database orders its keys, relative to the bytewise
+// order that gophia's scans of ranges of keys rely on.
+type keyOrder int
+
+const (
+	bytewiseOrder keyOrder = iota
+	reverseOrder
+	customOrder
+)
+
+// reverse returns the Order that reads keys in the same direction in a
+// database with the reverse key order.
+func (o Order) reverse() Order {
+	switch o {
+	case GT:
+		return LT
+	case GTE:
+		return LTE
+	case LT:
+		return GT
+	case LTE:
+		return GTE
+	}
+	return o
+}
+
+// scanRaw calls fn for each key and value, as it is stored, starting at
+// the start key and continuing while keys have the given prefix. System
+// keys are only scanned if the prefix is itself a system key. Rows are
+// read in batches of at most batch rows, and the cursor is closed before
+// fn is called for the batch, so fn is free to write to the database. If
+// fn returns errStopScan, the scan ends and scanRaw returns nil.
+//
+// The database lock must be held.
+func (db *Database) scanRaw(start, prefix []byte, batch int, fn func(key, value []byte) error) error {
+	if nil == start {
+		start = prefix
+	}
+	var order Order = GTE
+	for {
+		keys, values, err := db.readBatch(order, start, prefix, batch)
+		if nil != err {
+			return err
+		}
+		for i := range keys {
+			if err = fn(keys[i], values[i]); errStopScan == err {
+				return nil
+			} else if nil != err {
+				return err
+			}
+		}
+		if len(keys) < batch {
+			return nil
+		}
+		start, order = keys[len(keys)-1], GT
+	}
+}
+
+// readBatch reads at most batch keys and stored values from the
+// database, starting from the key, while the keys have the given prefix.
+// System keys are skipped unless the prefix is a system key. The order
+// is bytewise, whatever the key order of the database, so a database
+// with a custom key order can only be read without a prefix.
+func (db *Database) readBatch(order Order, key, prefix []byte, batch int) ([][]byte, [][]byte, error) {
+	switch {
+	case reverseOrder == db.order:
+		order = order.reverse()
+	case customOrder == db.order && 0 < len(prefix):
+		return nil, nil, ErrKeyOrder
+	}
+	cur, err := db.cursor(order, key)
+	if nil != err {
+		return nil, nil, err
+	}
+	defer cur.close()
+	cur.raw = true
+	system := isSysKey(prefix)
+	var keys, values [][]byte
+	for len(keys) < batch && cur.Fetch() {
+		k := cur.Key()
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		if !system && isSysKey(k) {
+			continue
+		}
+		keys = append(keys, k)
+		values = append(values, cur.Value())
+	}
+	return keys, values, nil
+}
+
+// prefixEnd returns the first key after every key with the prefix, or
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; 0 <= i; i-- {
+		if 0xff != end[i] {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package gophia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// schemaMarker is the first byte of an object encoded with a schema
+// header. It is followed by the uvarint length of the schema name, the
+// name, the uvarint version and then the gob encoding of the object.
+// Neither a gob stream nor UTF-8 text ever starts with this byte.
+const schemaMarker byte = 0xf7
+
+// Versioned is implemented by objects whose stored encoding records
+// the version of their schema. When a Versioned object is read, values
+// stored with an earlier version of the schema are brought up to date
+// by the registered migrations.
+type Versioned interface {
+	// SchemaVersion returns the name of the object's schema, and the
+	// current version of the schema.
+	SchemaVersion() (name string, version int)
+}
+
+// Migration converts the gob encoding of an object from one version of
+// its schema to the gob encoding of the next version.
+type Migration func(data []byte) ([]byte, error)
+
+// ErrSchemaTooNew is returned when reading an object stored with a later
+// version of its schema than the object being read into.
+var ErrSchemaTooNew = errors.New("Stored object has a newer schema version")
+
+var (
+	migrationsLock sync.RWMutex
+	migrations     = map[string]map[int]Migration{}
+)
+
+// RegisterMigration registers the migration of the named schema from
+// version from to version from+1.
+//
+// Objects stored before their type implemented Versioned are version 0.
+// If no migration from version 0 is registered, they are read as
+// version 1.
+func RegisterMigration(schema string, from int, m Migration) {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	if nil == migrations[schema] {
+		migrations[schema] = map[int]Migration{}
+	}
+	migrations[schema][from] = m
+}
+
+// RegisterObjectMigration registers a Migration from version from of
+// the named schema, decoded as a From, to version from+1, encoded from
+// the To returned by fn.
+func RegisterObjectMigration[From, To any](schema string, from int, fn func(From) (To, error)) {
+	RegisterMigration(schema, from, func(data []byte) ([]byte, error) {
+		var old From
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&old); nil != err {
+			return nil, err
+		}
+		updated, err := fn(old)
+		if nil != err {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(updated); nil != err {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// migration returns the registered migration, or nil if there is none.
+func migration(schema string, from int) Migration {
+	migrationsLock.RLock()
+	defer migrationsLock.RUnlock()
+	return migrations[schema][from]
+}
+
+// latestVersion returns the version reached by applying every registered
+// migration of the schema from the given version.
+func latestVersion(schema string, from int) int {
+	migrationsLock.RLock()
+	defer migrationsLock.RUnlock()
+	for nil != migrations[schema][from] {
+		from++
+	}
+	return from
+}
+
+// migrate applies the registered migrations to data, stored with the
+// given version of the schema, to bring it to version to.
+func migrate(schema string, data []byte, version, to int) ([]byte, error) {
+	if 0 == version && nil == migration(schema, 0) {
+		version = 1
+	}
+	if version > to {
+		return nil, ErrSchemaTooNew
+	}
+	for ; version < to; version++ {
+		m := migration(schema, version)
+		if nil == m {
+			return nil, fmt.Errorf("No migration registered for schema %s from version %d", schema, version)
+		}
+		var err error
+		if data, err = m(data); nil != err {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// encodeObject gob encodes the object, with a schema header if the
+// object is Versioned.
+func encodeObject(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if v, ok := value.(Versioned); ok {
+		name, version := v.SchemaVersion()
+		buf.Write(schemaHeader(name, version))
+	}
+	if err := gob.NewEncoder(&buf).Encode(value); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// schemaHeader returns the header for objects of the named schema at
+// the version.
+func schemaHeader(name string, version int) []byte {
+	header := []byte{schemaMarker}
+	header = binary.AppendUvarint(header, uint64(len(name)))
+	header = append(header, name...)
+	return binary.AppendUvarint(header, uint64(version))
+}
+
+// parseSchemaHeader returns the schema name, version and gob encoding of
+// a stored object. Objects stored without a header have no name and are
+// version 0.
+func parseSchemaHeader(buf []byte) (string, int, []byte, error) {
+	if 0 == len(buf) || schemaMarker != buf[0] {
+		return "", 0, buf, nil
+	}
+	r := bytes.NewReader(buf[1:])
+	size, err := binary.ReadUvarint(r)
+	if nil != err || size > uint64(r.Len()) {
+		return "", 0, nil, errors.New("Invalid schema header")
+	}
+	name := make([]byte, size)
+	r.Read(name)
+	version, err := binary.ReadUvarint(r)
+	if nil != err {
+		return "", 0, nil, errors.New("Invalid schema header")
+	}
+	return string(name), int(version), buf[len(buf)-r.Len():], nil
+}
+
+// decodeObject decodes an object encoded with encodeObject into out,
+// migrating it to the current version of its schema.
+func decodeObject(buf []byte, out interface{}) error {
+	name, version, data, err := parseSchemaHeader(buf)
+	if nil != err {
+		return err
+	}
+	to := version
+	if v, ok := out.(Versioned); ok {
+		name, to = v.SchemaVersion()
+	} else if "" != name {
+		to = latestVersion(name, version)
+	}
+	if "" != name && version != to {
+		if data, err = migrate(name, data, version, to); nil != err {
+			return err
+		}
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(out)
+}
+
+// MigrationProgress reports the progress of MigrateObjects.
+type MigrationProgress struct {
+	// Scanned is the number of values examined.
+	Scanned int
+	// Migrated is the number of values rewritten at a new version.
+	Migrated int
+	// Key is the last key examined.
+	Key []byte
+}
+
+// migrationCheckpoint is the system key recording how far an
+// interrupted MigrateObjects got.
+var migrationCheckpoint = sysKey("migration")
+
+// MigrateObjects eagerly rewrites every Versioned object in the database
+// at the latest version of its schema reachable by the registered
+// migrations. If progress is not nil, it is called after every batch of
+// values. Other calls on the database wait until MigrateObjects returns,
+// so progress must not use the database.
+//
+// MigrateObjects records its position in the database as it goes. If it
+// is interrupted, the next call resumes from where it stopped.
+//
+// Objects stored before their type implemented Versioned carry no
+// schema name, so they are only migrated when they are read.
+func (db *Database) MigrateObjects(progress func(MigrationProgress)) (MigrationProgress, error) {
+	const batch = 1000
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var p MigrationProgress
+	start, err := db.get(migrationCheckpoint)
+	if ErrNotFound == err {
+		start, err = nil, nil
+	}
+	if nil != err {
+		return p, err
+	}
+	err = db.scanRaw(start, nil, batch, func(key, _ []byte) error {
+		// The value is read with any deferred merges applied, since
+		// storing it discards them.
+		value, expires, exists, err := db.live(key)
+		if nil != err {
+			return err
+		}
+		p.Scanned++
+		p.Key = key
+		if name, version, data, err := parseSchemaHeader(value); exists && nil == err && "" != name {
+			if to := latestVersion(name, version); to != version {
+				if data, err = migrate(name, data, version, to); nil != err {
+					return fmt.Errorf("Migrating %q: %v", key, err)
+				}
+				if err = db.rewrite(key, append(schemaHeader(name, to), data...), expires); nil != err {
+					return err
+				}
+				p.Migrated++
+			}
+		}
+		if 0 == p.Scanned%batch {
+			if err := db.set(migrationCheckpoint, key); nil != err {
+				return err
+			}
+			if nil != progress {
+				progress(p)
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return p, err
+	}
+	if nil != progress {
+		progress(p)
+	}
+	return p, db.delete(migrationCheckpoint)
+}
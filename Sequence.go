@@ -0,0 +1,112 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Sequence generates increasing IDs, starting at 1, that are never
+// repeated, even across restarts.
+//
+// A Sequence leases ranges of IDs into memory, committing the highest ID
+// of each range to the database before handing any of them out. IDs
+// leased but not handed out before a crash are skipped. Several Sequences
+// with the same name, in the same or different processes, never hand out
+// the same ID.
+type Sequence struct {
+	db    *Database
+	key   []byte
+	lease uint64
+	// next is the next ID to hand out, and limit is the highest ID
+	// leased. Both are protected by the database lock.
+	next, limit uint64
+}
+
+// Sequence returns the named Sequence, which leases lease IDs at a time.
+// If lease is 0, 1000 IDs are leased at a time.
+func (db *Database) Sequence(name string, lease uint64) *Sequence {
+	if 0 == lease {
+		lease = 1000
+	}
+	return &Sequence{db: db, key: sysKey("sequence", name), lease: lease}
+}
+
+// highWater returns the highest ID leased from the Sequence.
+func (s *Sequence) highWater() (uint64, error) {
+	buf, err := s.db.get(s.key)
+	if ErrNotFound == err {
+		return 0, nil
+	}
+	if nil != err {
+		return 0, err
+	}
+	if 8 != len(buf) {
+		return 0, errors.New("Invalid stored sequence")
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// setHighWater stores the highest ID leased from the Sequence.
+func (s *Sequence) setHighWater(id uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	return s.db.set(s.key, buf)
+}
+
+// Next returns the next ID of the Sequence.
+//
+// Leasing a new range must be committed before its IDs are used, so Next
+// returns ErrTransactionInProgress if it needs to lease a range while a
+// transaction is in progress.
+func (s *Sequence) Next() (uint64, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	if s.next == s.limit {
+		if s.db.tx {
+			return 0, ErrTransactionInProgress
+		}
+		var next, limit uint64
+		err := s.db.update(func() error {
+			hw, err := s.highWater()
+			if nil != err {
+				return err
+			}
+			next, limit = hw, hw+s.lease
+			return s.setHighWater(limit)
+		})
+		if nil != err {
+			return 0, err
+		}
+		s.next, s.limit = next, limit
+	}
+	s.next++
+	return s.next, nil
+}
+
+// Release returns the unused IDs of the Sequence's current range to the
+// database, if no other range has been leased since, so that they are
+// not skipped. The Sequence can still be used after Release.
+func (s *Sequence) Release() error {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	if s.next == s.limit {
+		return nil
+	}
+	if s.db.tx {
+		return ErrTransactionInProgress
+	}
+	released := false
+	err := s.db.update(func() error {
+		hw, err := s.highWater()
+		if nil != err || hw != s.limit {
+			return err
+		}
+		released = true
+		return s.setHighWater(s.next)
+	})
+	// The range is only shortened once the release is committed.
+	if nil == err && released {
+		s.limit = s.next
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrKeyExists is returned by Undelete when the key has been set since it
+// was deleted.
+var ErrKeyExists = errors.New("Key already exists")
+
+// tombstoneKey returns the key of the system entry holding the tombstone
+// of the deleted key: the 8 byte big-endian deletion time, in nanoseconds
+// since the Unix epoch, followed by the value as it was stored.
+func tombstoneKey(key []byte) []byte {
+	return sysKey("tombstone", key)
+}
+
+func init() {
+	// A tombstone holds the value as it was stored under its key, after
+	// the deletion time.
+	registerSysValue("tombstone", func(_ []byte, parts []interface{}, _ []byte) (sysValue, bool) {
+		if 2 != len(parts) {
+			return sysValue{}, false
+		}
+		key, ok := parts[1].([]byte)
+		return sysValue{key, 8, true}, ok
+	})
+}
+
+// purgeKey returns the key of the system entry recording that the key was
+// deleted at the time. Purge scans these entries in time order.
+func purgeKey(deleted int64, key []byte) []byte {
+	return sysKey("purge", deleted, key)
+}
+
+// SoftDeletes sets whether Delete keeps the values of the keys it
+// deletes. While soft deletes are enabled, deleting a key moves its value
+// to a tombstone, so that Get, Has and Cursors no longer see the key, but
+// Undelete can restore it until the tombstone is purged.
+//
+// Keys deleted when they have expired do not get tombstones.
+func (db *Database) SoftDeletes(enabled bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.softDeletes = enabled
+}
+
+// live returns the value of the key, with any deferred merges applied,
+// its expiry time, and whether it exists.
+//
+// The database lock must be held.
+func (db *Database) live(key []byte) ([]byte, int64, bool, error) {
+	if db.pendingMerges {
+		return db.merged(key)
+	}
+	value, expires, err := db.load(key)
+	if ErrNotFound == err {
+		return nil, 0, false, nil
+	}
+	if nil != err {
+		return nil, 0, false, err
+	}
+	return value, expires, !expired(expires), nil
+}
+
+// tombstone is the writeHook that stores the tombstone of a key, if it
+// exists, before it is deleted.
+//
+// The database lock must be held, inside a transaction.
+func (db *Database) tombstone(w *write) error {
+	key := w.key
+	value, expires, exists, err := db.live(key)
+	if nil != err || !exists {
+		return err
+	}
+	stored, err := db.encodeValue(key, value)
+	if nil != err {
+		return err
+	}
+	deleted := time.Now().UnixNano()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(deleted))
+	if err = db.set(tombstoneKey(key), append(buf, db.joinExpiry(expires, stored)...)); nil != err {
+		return err
+	}
+	return db.set(purgeKey(deleted, key), key)
+}
+
+// DeletedAt returns the time at which the key was soft deleted, or
+// ErrNotFound if it has no tombstone.
+func (db *Database) DeletedAt(key []byte) (time.Time, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	buf, err := db.get(tombstoneKey(key))
+	if nil != err {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf))), nil
+}
+
+// Undelete restores the value of the soft deleted key from its tombstone.
+// It returns ErrNotFound if the key has no tombstone, and ErrKeyExists if
+// the key has been set since it was deleted.
+func (db *Database) Undelete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.update(func() error {
+		buf, err := db.get(tombstoneKey(key))
+		if nil != err {
+			return err
+		}
+		_, _, exists, err := db.live(key)
+		if nil != err {
+			return err
+		}
+		if exists {
+			return ErrKeyExists
+		}
+		value, expires, err := db.decodeStored(key, buf[8:])
+		if nil != err {
+			return err
+		}
+		if err = db.delete(tombstoneKey(key)); nil != err {
+			return err
+		}
+		if err = db.delete(purgeKey(int64(binary.BigEndian.Uint64(buf)), key)); nil != err {
+			return err
+		}
+		return db.store(key, value, expires)
+	})
+}
+
+// Purge permanently deletes the tombstones of keys deleted longer ago than
+// the grace period, in transactions of at most batch tombstones, and
+// returns the number of tombstones deleted. The database is unlocked
+// between transactions, so other callers are not held up for long.
+func (db *Database) Purge(grace time.Duration, batch int) (int, error) {
+	if 0 >= batch {
+		return 0, ErrBatchSize
+	}
+	total := 0
+	for {
+		db.lock.Lock()
+		purged, more, err := db.purgeBatch(grace, batch)
+		db.lock.Unlock()
+		total += purged
+		if nil != err || !more {
+			return total, err
+		}
+	}
+}
+
+// purgeBatch deletes the tombstones older than the grace period among the
+// next batch of purge entries, in a single transaction. It returns the
+// number of tombstones deleted, and whether there may be more to purge.
+func (db *Database) purgeBatch(grace time.Duration, batch int) (int, bool, error) {
+	prefix := sysKey("purge")
+	entries, keys, err := db.readBatch(GTE, prefix, prefix, batch)
+	if nil != err {
+		return 0, false, err
+	}
+	cutoff := time.Now().Add(-grace).UnixNano()
+	purged, more := 0, len(entries) == batch
+	err = db.update(func() error {
+		for i, entry := range entries {
+			t, _, err := decodeKeyPart(entry[len(prefix):])
+			if nil != err {
+				return err
+			}
+			if t.(int64) > cutoff {
+				more = false
+				return nil
+			}
+			// The entry is stale if the key has since been undeleted, or
+			// deleted again.
+			buf, err := db.get(tombstoneKey(keys[i]))
+			if nil == err {
+				if int64(binary.BigEndian.Uint64(buf)) == t.(int64) {
+					if err = db.delete(tombstoneKey(keys[i])); nil != err {
+						return err
+					}
+					purged++
+				}
+			} else if ErrNotFound != err {
+				return err
+			}
+			if err = db.delete(entry); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return 0, false, err
+	}
+	return purged, more, nil
+}
+
+// PurgerConfig configures the background purger started by StartPurger.
+type PurgerConfig struct {
+	// Interval is the time between purges. The default is one hour.
+	Interval time.Duration
+	// Grace is the time for which tombstones are kept. The default is
+	// one day.
+	Grace time.Duration
+	// BatchSize is the maximum number of tombstones deleted in each
+	// transaction. The default is 100.
+	BatchSize int
+	// OnError, if not nil, is called with any error from a purge.
+	OnError func(error)
+}
+
+// StartPurger starts a goroutine that periodically purges tombstones
+// older than the grace period, replacing any purger already running. Each
+// batch is purged in its own short transaction. A purge is skipped while
+// a transaction is in progress or a Cursor is open.
+//
+// The purger is stopped by StopPurger or Close.
+func (db *Database) StartPurger(config PurgerConfig) {
+	db.StopPurger()
+	if 0 >= config.Interval {
+		config.Interval = time.Hour
+	}
+	if 0 >= config.Grace {
+		config.Grace = 24 * time.Hour
+	}
+	if 0 >= config.BatchSize {
+		config.BatchSize = 100
+	}
+	s := db.startBackground(config.Interval, config.OnError, func() (bool, error) {
+		_, more, err := db.purgeBatch(config.Grace, config.BatchSize)
+		return more, err
+	})
+	db.lock.Lock()
+	db.purger = s
+	db.lock.Unlock()
+}
+
+// StopPurger stops the background purger, if one is running, and waits
+// for it to finish.
+func (db *Database) StopPurger() {
+	db.stopBackground(&db.purger)
+}
@@ -0,0 +1,264 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// SortedSet is a set of members ordered by score, like a Redis ZSET.
+// Each member is stored under a member key holding its score, and a score
+// key ordered by score and then member, kept consistent in a single
+// transaction.
+//
+// Members with equal scores are ordered bytewise. Ranges and ranks take
+// an Order: GT or GTE for ascending scores, and LT or LTE for
+// descending scores.
+type SortedSet struct {
+	db   *Database
+	name string
+}
+
+// ScoredMember is a member of a SortedSet and its score.
+type ScoredMember struct {
+	Member []byte
+	Score  float64
+}
+
+// SortedSet returns the named SortedSet.
+func (db *Database) SortedSet(name string) *SortedSet {
+	return &SortedSet{db: db, name: name}
+}
+
+func (z *SortedSet) memberKey(member []byte) []byte {
+	return sysKey("zset", z.name, "member", member)
+}
+
+func (z *SortedSet) scoreKey(score float64, member []byte) []byte {
+	return sysKey("zset", z.name, "score", score, member)
+}
+
+func (z *SortedSet) lenKey() []byte {
+	return sysKey("zset", z.name, "len")
+}
+
+// descending returns true if the Order ranges from high scores to low.
+func descending(order Order) bool {
+	return LT == order || LTE == order
+}
+
+// score returns the score of the member, and whether it is in the set.
+//
+// The database lock must be held.
+func (z *SortedSet) score(member []byte) (float64, bool, error) {
+	buf, err := z.db.get(z.memberKey(member))
+	if ErrNotFound == err {
+		return 0, false, nil
+	}
+	if nil != err {
+		return 0, false, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), true, nil
+}
+
+// Add adds the member to the set with the score, or updates its score if
+// it is already in the set. It returns whether the member was added.
+func (z *SortedSet) Add(member []byte, score float64) (bool, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	added := false
+	err := z.db.update(func() error {
+		old, exists, err := z.score(member)
+		if nil != err {
+			return err
+		}
+		if exists {
+			if err = z.db.delete(z.scoreKey(old, member)); nil != err {
+				return err
+			}
+		} else if err = z.db.addLength(z.lenKey(), 1); nil != err {
+			return err
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, math.Float64bits(score))
+		if err = z.db.set(z.scoreKey(score, member), buf); nil != err {
+			return err
+		}
+		added = !exists
+		return z.db.set(z.memberKey(member), buf)
+	})
+	return added, err
+}
+
+// Remove removes the member from the set, and returns whether it was in
+// the set.
+func (z *SortedSet) Remove(member []byte) (bool, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	removed := false
+	err := z.db.update(func() error {
+		score, exists, err := z.score(member)
+		if nil != err || !exists {
+			return err
+		}
+		if err = z.db.delete(z.scoreKey(score, member)); nil != err {
+			return err
+		}
+		if err = z.db.delete(z.memberKey(member)); nil != err {
+			return err
+		}
+		removed = true
+		return z.db.addLength(z.lenKey(), -1)
+	})
+	return removed, err
+}
+
+// Score returns the score of the member, or ErrNotFound if it is not in
+// the set.
+func (z *SortedSet) Score(member []byte) (float64, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	score, exists, err := z.score(member)
+	if nil == err && !exists {
+		err = ErrNotFound
+	}
+	return score, err
+}
+
+// Len returns the number of members in the set.
+func (z *SortedSet) Len() (int, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	return z.db.length(z.lenKey())
+}
+
+// scan calls fn with the members in the order, starting from the score
+// key from, or from the first or last member if from is nil. fn may
+// return errStopScan to end the scan.
+//
+// The database lock must be held.
+func (z *SortedSet) scan(order Order, from []byte, fn func(m ScoredMember) error) error {
+	const batch = 1000
+	prefix := sysKey("zset", z.name, "score")
+	desc := descending(order)
+	if desc {
+		order = LT
+		if nil == from {
+			from = prefixEnd(prefix)
+		}
+	} else {
+		order = GTE
+		if nil == from {
+			from = prefix
+		}
+	}
+	for {
+		keys, _, err := z.db.readBatch(order, from, prefix, batch)
+		if nil != err {
+			return err
+		}
+		for _, key := range keys {
+			parts, err := DecodeKey(key[len(prefix):])
+			if nil != err {
+				return err
+			}
+			if 2 != len(parts) {
+				return ErrInvalidKey
+			}
+			err = fn(ScoredMember{parts[1].([]byte), parts[0].(float64)})
+			if errStopScan == err {
+				return nil
+			} else if nil != err {
+				return err
+			}
+		}
+		if len(keys) < batch {
+			return nil
+		}
+		if from, order = keys[len(keys)-1], GT; desc {
+			order = LT
+		}
+	}
+}
+
+// Rank returns the position of the member in the order, starting at 0,
+// or ErrNotFound if it is not in the set. The members before it are
+// counted, so Rank takes time proportional to the rank.
+func (z *SortedSet) Rank(member []byte, order Order) (int, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	_, exists, err := z.score(member)
+	if nil != err {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrNotFound
+	}
+	rank := 0
+	err = z.scan(order, nil, func(m ScoredMember) error {
+		if string(member) == string(m.Member) {
+			return errStopScan
+		}
+		rank++
+		return nil
+	})
+	return rank, err
+}
+
+// RangeByScore returns the members with scores from min to max,
+// inclusive, in the order.
+func (z *SortedSet) RangeByScore(min, max float64, order Order) ([]ScoredMember, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	from := sysKey("zset", z.name, "score", min)
+	if descending(order) {
+		from = prefixEnd(sysKey("zset", z.name, "score", max))
+	}
+	var members []ScoredMember
+	err := z.scan(order, from, func(m ScoredMember) error {
+		if m.Score < min || m.Score > max {
+			return errStopScan
+		}
+		members = append(members, m)
+		return nil
+	})
+	return members, err
+}
+
+// RangeByRank returns the members with ranks from start to stop,
+// inclusive, in the order. Negative ranks count back from the end of the
+// order, so -1 is the last member.
+func (z *SortedSet) RangeByRank(start, stop int, order Order) ([]ScoredMember, error) {
+	z.db.lock.Lock()
+	defer z.db.lock.Unlock()
+	if 0 > start || 0 > stop {
+		n, err := z.db.length(z.lenKey())
+		if nil != err {
+			return nil, err
+		}
+		if 0 > start {
+			start += n
+		}
+		if 0 > stop {
+			stop += n
+		}
+	}
+	if 0 > start {
+		start = 0
+	}
+	var members []ScoredMember
+	if start > stop {
+		return members, nil
+	}
+	rank := 0
+	err := z.scan(order, nil, func(m ScoredMember) error {
+		if rank > stop {
+			return errStopScan
+		}
+		if rank >= start {
+			members = append(members, m)
+		}
+		rank++
+		return nil
+	})
+	return members, err
+}
@@ -0,0 +1,335 @@
+package gophia
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// TextExtractor extracts the text to index from a row. It is called with
+// the key and the value as it would be returned by Get.
+type TextExtractor func(key, value []byte) []string
+
+// Tokenize splits text into lower case words of letters and digits. It
+// is the default tokenizer of text indexes.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ObjectTextFields returns a TextExtractor for rows holding gob encoded
+// objects, as stored by SetAO, that extracts the named string fields of
+// each object decoded as a T.
+func ObjectTextFields[T any](fields ...string) TextExtractor {
+	return func(_, value []byte) []string {
+		var obj T
+		if err := decodeObject(value, &obj); nil != err {
+			return nil
+		}
+		v := reflect.Indirect(reflect.ValueOf(obj))
+		if reflect.Struct != v.Kind() {
+			return nil
+		}
+		var text []string
+		for _, name := range fields {
+			if f := v.FieldByName(name); f.IsValid() && reflect.String == f.Kind() {
+				text = append(text, f.String())
+			}
+		}
+		return text
+	}
+}
+
+// JSONTextFields returns a TextExtractor for rows holding JSON objects,
+// that extracts the named top-level string fields of each object.
+func JSONTextFields(fields ...string) TextExtractor {
+	return func(_, value []byte) []string {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(value, &obj); nil != err {
+			return nil
+		}
+		var text []string
+		for _, name := range fields {
+			if s, ok := obj[name].(string); ok {
+				text = append(text, s)
+			}
+		}
+		return text
+	}
+}
+
+// textIndex is a full-text index added to a database.
+type textIndex struct {
+	extract  TextExtractor
+	tokenize func(string) []string
+}
+
+// AddTextIndex adds a full-text index to the database. Once added, the
+// text extracted from every row is split into terms by the tokenizer, or
+// by Tokenize if tokenize is nil, and the posting lists of the terms are
+// maintained in the same transaction as every Set and Delete.
+//
+// Like secondary indexes, text indexes must be added each time the
+// database is opened, and RebuildIndex indexes rows written while the
+// index was not added.
+func (db *Database) AddTextIndex(name string, extract TextExtractor, tokenize func(string) []string) {
+	if nil == tokenize {
+		tokenize = Tokenize
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.textIndexes {
+		db.textIndexes = map[string]*textIndex{}
+	}
+	db.textIndexes[name] = &textIndex{extract, tokenize}
+}
+
+// terms returns the number of occurrences of each term in the row.
+func (ti *textIndex) terms(key, value []byte) map[string]uint64 {
+	terms := map[string]uint64{}
+	for _, text := range ti.extract(key, value) {
+		for _, term := range ti.tokenize(text) {
+			terms[term]++
+		}
+	}
+	return terms
+}
+
+// postingKey returns the key of the posting of the row key for the term
+// in the named text index. The posting's value is the number of times
+// the term occurs in the row.
+func postingKey(name, term string, key []byte) []byte {
+	return sysKey("text", name, term, key)
+}
+
+// textDocsKey returns the key of the number of rows in the named text
+// index.
+func textDocsKey(name string) []byte {
+	return sysKey("textdocs", name)
+}
+
+// addTextDocs adds delta to the number of rows in the named text index.
+func (db *Database) addTextDocs(name string, delta int64) error {
+	var n uint64
+	if buf, err := db.get(textDocsKey(name)); nil == err {
+		n = binary.BigEndian.Uint64(buf)
+	} else if ErrNotFound != err {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(int64(n)+delta))
+	return db.set(textDocsKey(name), buf)
+}
+
+// textIndex adds the postings of the row to the named text index.
+func (db *Database) textIndex(name string, key, value []byte) error {
+	terms := db.textIndexes[name].terms(key, value)
+	if 0 == len(terms) {
+		return nil
+	}
+	for term, n := range terms {
+		if err := db.set(postingKey(name, term, key), binary.AppendUvarint(nil, n)); nil != err {
+			return err
+		}
+	}
+	return db.addTextDocs(name, 1)
+}
+
+// textUnindex removes the postings of the row from the named text index.
+func (db *Database) textUnindex(name string, key, value []byte) error {
+	terms := db.textIndexes[name].terms(key, value)
+	if 0 == len(terms) {
+		return nil
+	}
+	for term := range terms {
+		if err := db.delete(postingKey(name, term, key)); nil != err {
+			return err
+		}
+	}
+	return db.addTextDocs(name, -1)
+}
+
+// rebuildTextIndex removes every posting in the named text index, and
+// re-indexes every row in the database.
+func (db *Database) rebuildTextIndex(name string) error {
+	err := db.scanRaw(nil, sysKey("text", name), 1000, func(key, _ []byte) error {
+		return db.delete(key)
+	})
+	if nil == err {
+		err = db.delete(textDocsKey(name))
+	}
+	if nil != err {
+		return err
+	}
+	return db.scanRaw(nil, nil, 1000, func(key, stored []byte) error {
+		value, _, err := db.decodeStored(key, stored)
+		if nil != err {
+			return err
+		}
+		return db.textIndex(name, key, value)
+	})
+}
+
+// TextQuery is a query against a text index. Queries are built with
+// Term, Prefix, And and Or.
+type TextQuery interface {
+	// scores returns the score of each row matching the query.
+	scores(db *Database, name string) (map[string]float64, error)
+}
+
+type termQuery struct {
+	term   string
+	prefix bool
+}
+
+// Term returns a TextQuery matching rows containing the term. The term
+// is matched exactly, so it should be tokenized as the index's terms are.
+func Term(term string) TextQuery {
+	return termQuery{term, false}
+}
+
+// Prefix returns a TextQuery matching rows containing any term that
+// starts with the prefix.
+func Prefix(prefix string) TextQuery {
+	return termQuery{prefix, true}
+}
+
+// scores reads the postings of the matching terms with a cursor, scoring
+// each row by the sum over the terms of the term frequency multiplied by
+// the inverse document frequency.
+func (q termQuery) scores(db *Database, name string) (map[string]float64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var docs float64
+	if buf, err := db.get(textDocsKey(name)); nil == err {
+		docs = float64(binary.BigEndian.Uint64(buf))
+	} else if ErrNotFound != err {
+		return nil, err
+	}
+	base := sysKey("text", name)
+	prefix := sysKey("text", name, q.term)
+	if q.prefix {
+		// Drop the terminator of the term to match longer terms.
+		prefix = prefix[:len(prefix)-1]
+	}
+	scores := map[string]float64{}
+	var term interface{}
+	var postings map[string]uint64
+	score := func() {
+		idf := math.Log(1 + docs/float64(len(postings)))
+		for key, n := range postings {
+			scores[key] += float64(n) * idf
+		}
+	}
+	err := db.scanRaw(nil, prefix, 1000, func(entry, value []byte) error {
+		t, rest, err := decodeKeyPart(entry[len(base):])
+		if nil != err {
+			return err
+		}
+		if t != term {
+			if nil != term {
+				score()
+			}
+			term, postings = t, map[string]uint64{}
+		}
+		key, _, err := decodeKeyPart(rest)
+		if nil != err {
+			return err
+		}
+		n, _ := binary.Uvarint(value)
+		postings[string(key.([]byte))] = n
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+	if nil != term {
+		score()
+	}
+	return scores, nil
+}
+
+type boolQuery struct {
+	all     bool
+	queries []TextQuery
+}
+
+// And returns a TextQuery matching rows that match all the queries.
+func And(queries ...TextQuery) TextQuery {
+	return boolQuery{true, queries}
+}
+
+// Or returns a TextQuery matching rows that match any of the queries.
+func Or(queries ...TextQuery) TextQuery {
+	return boolQuery{false, queries}
+}
+
+// scores combines the scores of the queries, adding the scores of rows
+// that match more than one.
+func (q boolQuery) scores(db *Database, name string) (map[string]float64, error) {
+	var scores map[string]float64
+	for i, query := range q.queries {
+		s, err := query.scores(db, name)
+		if nil != err {
+			return nil, err
+		}
+		switch {
+		case 0 == i:
+			scores = s
+		case q.all:
+			for key := range scores {
+				if _, ok := s[key]; ok {
+					scores[key] += s[key]
+				} else {
+					delete(scores, key)
+				}
+			}
+		default:
+			for key, score := range s {
+				scores[key] += score
+			}
+		}
+	}
+	return scores, nil
+}
+
+// SearchResult is a row matching a TextQuery.
+type SearchResult struct {
+	Key   []byte
+	Score float64
+}
+
+// Search returns the rows matching the query in the named text index,
+// highest scoring first, up to limit results. A limit of 0 returns all
+// the matching rows.
+func (db *Database) Search(name string, query TextQuery, limit int) ([]SearchResult, error) {
+	db.lock.Lock()
+	_, ok := db.textIndexes[name]
+	db.lock.Unlock()
+	if !ok {
+		return nil, ErrUnknownIndex
+	}
+	scores, err := query.scores(db, name)
+	if nil != err {
+		return nil, err
+	}
+	results := make([]SearchResult, 0, len(scores))
+	for key, score := range scores {
+		results = append(results, SearchResult{[]byte(key), score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return string(results[i].Key) < string(results[j].Key)
+	})
+	if 0 < limit && limit < len(results) {
+		results = results[:limit]
+	}
+	return results, nil
+}
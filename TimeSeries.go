@@ -0,0 +1,454 @@
+package gophia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Series is a time series of float64 points in a Database, identified by
+// a name and a set of tags.
+//
+// Points are stored under system keys ordered by timestamp, so they are
+// hidden from Cursors, and go through the database's ValueCodecs.
+type Series struct {
+	db *Database
+	id []byte
+}
+
+// Series returns the time series with the name and tags.
+func (db *Database) Series(name string, tags map[string]string) *Series {
+	names := make([]string, 0, len(tags))
+	for k := range tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	parts := []interface{}{name}
+	for _, k := range names {
+		parts = append(parts, k, tags[k])
+	}
+	return &Series{db: db, id: MustEncodeKey(parts...)}
+}
+
+// pointKey returns the key of the point of the series at the timestamp.
+func pointKey(id []byte, ts int64) []byte {
+	return sysKey("ts", id, ts)
+}
+
+// rollupKey returns the key of the aggregate of the window starting at
+// the timestamp, in the rollup of the series with the window size.
+func rollupKey(id []byte, window time.Duration, start int64) []byte {
+	return sysKey("tsrollup", id, int64(window), start)
+}
+
+func init() {
+	registerSysValue("ts", wholeSysValue)
+	registerSysValue("tsrollup", wholeSysValue)
+}
+
+// Add adds a point to the series, replacing any point at the same time.
+func (s *Series) Add(t time.Time, value float64) error {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	key := pointKey(s.id, t.UnixNano())
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(value))
+	stored, err := s.db.encodeValue(key, buf)
+	if nil != err {
+		return err
+	}
+	return s.db.set(key, stored)
+}
+
+// scan calls fn with the timestamp and value of each point of the series
+// from (inclusive) to to (exclusive), in time order. fn may return
+// errStopScan to end the scan.
+//
+// The database lock must be held.
+func (s *Series) scan(from, to int64, fn func(ts int64, value float64) error) error {
+	prefix := sysKey("ts", s.id)
+	return s.db.scanRaw(pointKey(s.id, from), prefix, 1000, func(key, stored []byte) error {
+		ts, _, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		if ts.(int64) >= to {
+			return errStopScan
+		}
+		buf, err := s.db.decodeValue(key, stored)
+		if nil != err {
+			return err
+		}
+		if 8 != len(buf) {
+			return errors.New("Invalid time series point")
+		}
+		return fn(ts.(int64), math.Float64frombits(binary.BigEndian.Uint64(buf)))
+	})
+}
+
+// Range calls fn with each point of the series from (inclusive) to to
+// (exclusive), in time order. Points are read in batches, and fn is
+// called without the database lock held, so it may use the database.
+func (s *Series) Range(from, to time.Time, fn func(t time.Time, value float64) error) error {
+	const batch = 1000
+	start, end := from.UnixNano(), to.UnixNano()
+	for start < end {
+		var times []int64
+		var values []float64
+		s.db.lock.Lock()
+		err := s.scan(start, end, func(ts int64, value float64) error {
+			times, values = append(times, ts), append(values, value)
+			if batch == len(times) {
+				return errStopScan
+			}
+			return nil
+		})
+		s.db.lock.Unlock()
+		if nil != err {
+			return err
+		}
+		for i, ts := range times {
+			if err = fn(time.Unix(0, ts), values[i]); nil != err {
+				return err
+			}
+		}
+		if len(times) < batch {
+			return nil
+		}
+		start = times[len(times)-1] + 1
+	}
+	return nil
+}
+
+// Aggregate summarizes the points of a series in a window of time.
+type Aggregate struct {
+	Start         time.Time
+	Count         int
+	Min, Max, Sum float64
+}
+
+// Avg returns the mean of the points in the window.
+func (a Aggregate) Avg() float64 {
+	if 0 == a.Count {
+		return 0
+	}
+	return a.Sum / float64(a.Count)
+}
+
+// add adds a point to the Aggregate.
+func (a *Aggregate) add(value float64) {
+	if 0 == a.Count || value < a.Min {
+		a.Min = value
+	}
+	if 0 == a.Count || value > a.Max {
+		a.Max = value
+	}
+	a.Count++
+	a.Sum += value
+}
+
+// windowStart returns the start of the window of the size containing
+// the timestamp. Windows are aligned to the Unix epoch.
+func windowStart(ts int64, window time.Duration) int64 {
+	start := ts - ts%int64(window)
+	if start > ts {
+		start -= int64(window)
+	}
+	return start
+}
+
+// aggregate returns the Aggregates of the windows of the size that
+// contain points of the series from (inclusive) to to (exclusive).
+//
+// The database lock must be held.
+func (s *Series) aggregate(from, to int64, window time.Duration) ([]Aggregate, error) {
+	var aggs []Aggregate
+	err := s.scan(from, to, func(ts int64, value float64) error {
+		start := windowStart(ts, window)
+		if 0 == len(aggs) || aggs[len(aggs)-1].Start.UnixNano() != start {
+			aggs = append(aggs, Aggregate{Start: time.Unix(0, start)})
+		}
+		aggs[len(aggs)-1].add(value)
+		return nil
+	})
+	return aggs, err
+}
+
+// Aggregate returns the count, minimum, maximum and sum of the points of
+// the series from (inclusive) to to (exclusive), in windows of the size
+// aligned to the Unix epoch. Windows without points are left out.
+func (s *Series) Aggregate(from, to time.Time, window time.Duration) ([]Aggregate, error) {
+	if 0 >= window {
+		return nil, errors.New("Window must be positive")
+	}
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	return s.aggregate(from.UnixNano(), to.UnixNano(), window)
+}
+
+// Rollup is a coarser series of Aggregates of a series' points, kept by
+// the downsampler.
+type Rollup struct {
+	// Window is the size of the windows of the rollup.
+	Window time.Duration
+	// Retention is how long the rollup's Aggregates are kept. 0 keeps
+	// them forever.
+	Retention time.Duration
+}
+
+// RetentionPolicy configures the downsampling and retention of a series.
+type RetentionPolicy struct {
+	// Raw is how long the series' points are kept. 0 keeps them forever.
+	Raw time.Duration
+	// Rollups are the coarser series into which the points are
+	// downsampled before they are deleted.
+	Rollups []Rollup
+}
+
+// policyKey returns the key of the RetentionPolicy of the series.
+func policyKey(id []byte) []byte {
+	return sysKey("tspolicy", id)
+}
+
+// rollupMarkKey returns the key of the end of the last window written to
+// the rollup of the series with the window size.
+func rollupMarkKey(id []byte, window time.Duration) []byte {
+	return sysKey("tsmark", id, int64(window))
+}
+
+// SetRetention sets the RetentionPolicy of the series, which is applied
+// by Downsample and the background downsampler. The Raw retention must
+// be at least as long as the Window of every rollup.
+func (s *Series) SetRetention(policy RetentionPolicy) error {
+	for _, r := range policy.Rollups {
+		if 0 >= r.Window {
+			return errors.New("Rollup window must be positive")
+		}
+		// Points must be kept until the window they fall in has been
+		// rolled up.
+		if 0 < policy.Raw && policy.Raw < r.Window {
+			return errors.New("Raw retention must not be shorter than a rollup window")
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(policy); nil != err {
+		return err
+	}
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	return s.db.set(policyKey(s.id), buf.Bytes())
+}
+
+// Rollups returns the Aggregates of the rollup of the series with the
+// window size, for windows starting from (inclusive) to to (exclusive).
+func (s *Series) Rollups(window time.Duration, from, to time.Time) ([]Aggregate, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	prefix := sysKey("tsrollup", s.id, int64(window))
+	end := to.UnixNano()
+	var aggs []Aggregate
+	err := s.db.scanRaw(rollupKey(s.id, window, from.UnixNano()), prefix, 1000, func(key, stored []byte) error {
+		start, _, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		if start.(int64) >= end {
+			return errStopScan
+		}
+		buf, err := s.db.decodeValue(key, stored)
+		if nil != err {
+			return err
+		}
+		if 32 != len(buf) {
+			return errors.New("Invalid time series rollup")
+		}
+		aggs = append(aggs, Aggregate{
+			Start: time.Unix(0, start.(int64)),
+			Count: int(binary.BigEndian.Uint64(buf)),
+			Min:   math.Float64frombits(binary.BigEndian.Uint64(buf[8:])),
+			Max:   math.Float64frombits(binary.BigEndian.Uint64(buf[16:])),
+			Sum:   math.Float64frombits(binary.BigEndian.Uint64(buf[24:])),
+		})
+		return nil
+	})
+	return aggs, err
+}
+
+// downsample writes the Aggregates of the windows of the rollup that
+// have ended since it was last downsampled.
+//
+// The database lock must be held.
+func (s *Series) downsample(r Rollup, now int64) error {
+	var mark int64
+	if buf, err := s.db.get(rollupMarkKey(s.id, r.Window)); nil == err {
+		mark = int64(binary.BigEndian.Uint64(buf))
+	} else if ErrNotFound != err {
+		return err
+	} else {
+		// Start from the window of the series' first point.
+		found := false
+		err = s.scan(math.MinInt64, math.MaxInt64, func(ts int64, _ float64) error {
+			mark, found = windowStart(ts, r.Window), true
+			return errStopScan
+		})
+		if nil != err || !found {
+			return err
+		}
+	}
+	end := windowStart(now, r.Window)
+	if mark >= end {
+		return nil
+	}
+	aggs, err := s.aggregate(mark, end, r.Window)
+	if nil != err {
+		return err
+	}
+	for _, a := range aggs {
+		buf := make([]byte, 32)
+		binary.BigEndian.PutUint64(buf, uint64(a.Count))
+		binary.BigEndian.PutUint64(buf[8:], math.Float64bits(a.Min))
+		binary.BigEndian.PutUint64(buf[16:], math.Float64bits(a.Max))
+		binary.BigEndian.PutUint64(buf[24:], math.Float64bits(a.Sum))
+		key := rollupKey(s.id, r.Window, a.Start.UnixNano())
+		if buf, err = s.db.encodeValue(key, buf); nil != err {
+			return err
+		}
+		if err = s.db.set(key, buf); nil != err {
+			return err
+		}
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(end))
+	return s.db.set(rollupMarkKey(s.id, r.Window), buf)
+}
+
+// deleteBefore deletes the keys with the prefix, followed by a timestamp
+// before the time.
+//
+// The database lock must be held.
+func (db *Database) deleteBefore(prefix []byte, before int64) error {
+	return db.scanRaw(nil, prefix, 1000, func(key, _ []byte) error {
+		ts, _, err := decodeKeyPart(key[len(prefix):])
+		if nil != err {
+			return err
+		}
+		if ts.(int64) >= before {
+			return errStopScan
+		}
+		return db.delete(key)
+	})
+}
+
+// applyPolicy downsamples the series, and deletes its points and
+// Aggregates that are older than the policy keeps, in a single
+// transaction.
+//
+// The database lock must be held.
+func (s *Series) applyPolicy(policy RetentionPolicy, now int64) error {
+	return s.db.update(func() error {
+		for _, r := range policy.Rollups {
+			if err := s.downsample(r, now); nil != err {
+				return err
+			}
+			if 0 < r.Retention {
+				err := s.db.deleteBefore(sysKey("tsrollup", s.id, int64(r.Window)), now-int64(r.Retention))
+				if nil != err {
+					return err
+				}
+			}
+		}
+		if 0 < policy.Raw {
+			return s.db.deleteBefore(sysKey("ts", s.id), now-int64(policy.Raw))
+		}
+		return nil
+	})
+}
+
+// Downsample applies the RetentionPolicy of every series that has one.
+// Each series is downsampled in its own transaction. Points added to a
+// window after it has been downsampled are not added to its Aggregate.
+func (db *Database) Downsample() error {
+	prefix := sysKey("tspolicy")
+	var from []byte
+	for {
+		db.lock.Lock()
+		more, err := db.downsampleNext(prefix, &from)
+		db.lock.Unlock()
+		if nil != err || !more {
+			return err
+		}
+	}
+}
+
+// downsampleNext applies the RetentionPolicy of the next series after
+// the policy key from, and updates from. It returns false when there are
+// no more series.
+//
+// The database lock must be held.
+func (db *Database) downsampleNext(prefix []byte, from *[]byte) (bool, error) {
+	var order Order = GT
+	if nil == *from {
+		*from, order = prefix, GTE
+	}
+	keys, values, err := db.readBatch(order, *from, prefix, 1)
+	if nil != err || 0 == len(keys) {
+		return false, err
+	}
+	*from = keys[0]
+	id, _, err := decodeKeyPart(keys[0][len(prefix):])
+	if nil != err {
+		return false, err
+	}
+	var policy RetentionPolicy
+	if err = gob.NewDecoder(bytes.NewReader(values[0])).Decode(&policy); nil != err {
+		return false, err
+	}
+	s := &Series{db: db, id: id.([]byte)}
+	return true, s.applyPolicy(policy, time.Now().UnixNano())
+}
+
+// DownsamplerConfig configures the background downsampler started by
+// StartDownsampler.
+type DownsamplerConfig struct {
+	// Interval is the time between runs. The default is one minute.
+	Interval time.Duration
+	// OnError, if not nil, is called with any error from a run.
+	OnError func(error)
+}
+
+// StartDownsampler starts a goroutine that periodically applies the
+// RetentionPolicy of every series, replacing any downsampler already
+// running. A series is skipped while a transaction is in progress or a
+// Cursor is open.
+//
+// The downsampler is stopped by StopDownsampler or Close.
+func (db *Database) StartDownsampler(config DownsamplerConfig) {
+	db.StopDownsampler()
+	if 0 >= config.Interval {
+		config.Interval = time.Minute
+	}
+	prefix := sysKey("tspolicy")
+	// from is the last series downsampled. Each run starts again from the
+	// first series once the last has been downsampled.
+	var from []byte
+	s := db.startBackground(config.Interval, config.OnError, func() (bool, error) {
+		more, err := db.downsampleNext(prefix, &from)
+		if !more {
+			from = nil
+		}
+		return more, err
+	})
+	db.lock.Lock()
+	db.downsampler = s
+	db.lock.Unlock()
+}
+
+// StopDownsampler stops the background downsampler, if one is running,
+// and waits for it to finish.
+func (db *Database) StopDownsampler() {
+	db.stopBackground(&db.downsampler)
+}
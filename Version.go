@@ -0,0 +1,224 @@
+package gophia
+
+import (
+	"errors"
+	"time"
+)
+
+// A stored version starts with versionValue, followed by the value as it
+// was stored under the key, or is versionDeleted if the key was deleted.
+const (
+	versionDeleted byte = 0
+	versionValue   byte = 1
+)
+
+// VersionPolicy sets which versions of each key are kept. The newest
+// version of a key is always kept. A zero VersionPolicy keeps every
+// version.
+type VersionPolicy struct {
+	// MaxVersions, if not 0, is the greatest number of versions kept for
+	// each key.
+	MaxVersions int
+	// MaxAge, if not 0, is the age after which versions are pruned.
+	MaxAge time.Duration
+}
+
+// Version is a historical value of a key.
+type Version struct {
+	Time  time.Time
+	Value []byte
+	// Deleted is true if the key was deleted at the Time.
+	Deleted bool
+}
+
+// versionKey returns the key of the system entry holding the version of
+// the key written at the time.
+func versionKey(key []byte, t int64) []byte {
+	return sysKey("version", key, t)
+}
+
+func init() {
+	// A version holds the value as it was stored under its key.
+	registerSysValue("version", func(_ []byte, parts []interface{}, stored []byte) (sysValue, bool) {
+		if 3 != len(parts) || 0 == len(stored) || versionValue != stored[0] {
+			return sysValue{}, false
+		}
+		key, ok := parts[1].([]byte)
+		return sysValue{key, 1, true}, ok
+	})
+}
+
+// Versioning sets the VersionPolicy of the database. While the policy is
+// not nil, every write and delete of a key also stores a version of the
+// key, so that its history can be read with GetAsOf and Versions, and
+// older versions are pruned by the policy as the key is written. A nil
+// policy stops storing versions, leaving the existing versions in place.
+//
+// Keys written before versioning was enabled have no history until they
+// are next written.
+func (db *Database) Versioning(policy *VersionPolicy) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.versioning = policy
+}
+
+// addVersion is the writeHook that stores a version of each key written,
+// or a deleted version if the key is deleted, and prunes the key's
+// versions.
+//
+// The database lock must be held, inside a transaction.
+func (db *Database) addVersion(w *write) error {
+	t := time.Now().UnixNano()
+	if t <= db.versionTime {
+		t = db.versionTime + 1
+	}
+	db.versionTime = t
+	version := []byte{versionDeleted}
+	if !w.deleted {
+		version = append([]byte{versionValue}, w.stored...)
+	}
+	if err := db.set(versionKey(w.key, t), version); nil != err {
+		return err
+	}
+	return db.pruneVersions(w.key)
+}
+
+// pruneVersions deletes the versions of the key that the VersionPolicy
+// does not keep.
+//
+// The database lock must be held.
+func (db *Database) pruneVersions(key []byte) error {
+	policy := db.versioning
+	if nil == policy || (0 == policy.MaxVersions && 0 == policy.MaxAge) {
+		return nil
+	}
+	var cutoff int64
+	if 0 != policy.MaxAge {
+		cutoff = time.Now().Add(-policy.MaxAge).UnixNano()
+	}
+	prefix := sysKey("version", key)
+	from := prefixEnd(prefix)
+	n := 0
+	for {
+		entries, _, err := db.readBatch(LT, from, prefix, 1000)
+		if nil != err {
+			return err
+		}
+		for _, entry := range entries {
+			n++
+			t, _, err := decodeKeyPart(entry[len(prefix):])
+			if nil != err {
+				return err
+			}
+			if 1 == n || ((0 == policy.MaxVersions || n <= policy.MaxVersions) && t.(int64) >= cutoff) {
+				continue
+			}
+			if err = db.delete(entry); nil != err {
+				return err
+			}
+		}
+		if len(entries) < 1000 {
+			return nil
+		}
+		from = entries[len(entries)-1]
+	}
+}
+
+// PruneVersions applies the VersionPolicy to the versions of every key,
+// pruning each key in its own transaction. Versions are otherwise only
+// pruned when their key is written, so keys that are no longer written
+// keep versions past their MaxAge until PruneVersions is called.
+func (db *Database) PruneVersions() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if nil == db.versioning {
+		return nil
+	}
+	prefix := sysKey("version")
+	var last []byte
+	return db.scanRaw(nil, prefix, 1000, func(entry, _ []byte) error {
+		key, _, err := decodeKeyPart(entry[len(prefix):])
+		if nil != err {
+			return err
+		}
+		if nil != last && string(last) == string(key.([]byte)) {
+			return nil
+		}
+		last = key.([]byte)
+		return db.update(func() error {
+			return db.pruneVersions(last)
+		})
+	})
+}
+
+// decodeVersion returns the version of the key stored at the time t, as
+// it was at the time asOf.
+func (db *Database) decodeVersion(key []byte, t, asOf int64, stored []byte) (Version, error) {
+	v := Version{Time: time.Unix(0, t)}
+	if 0 == len(stored) {
+		return v, errors.New("Invalid stored version")
+	}
+	if versionDeleted == stored[0] {
+		v.Deleted = true
+		return v, nil
+	}
+	value, expires, err := db.decodeStored(key, stored[1:])
+	if nil != err {
+		return v, err
+	}
+	// A value that had expired by the time asOf was absent.
+	if 0 != expires && expires <= asOf {
+		v.Deleted = true
+		return v, nil
+	}
+	v.Value = value
+	return v, nil
+}
+
+// GetAsOf returns the value the key had at the time, or ErrNotFound if
+// the key had no value then, or its history has been pruned.
+func (db *Database) GetAsOf(key []byte, t time.Time) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	prefix := sysKey("version", key)
+	entries, stored, err := db.readBatch(LTE, versionKey(key, t.UnixNano()), prefix, 1)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(entries) {
+		return nil, ErrNotFound
+	}
+	vt, _, err := decodeKeyPart(entries[0][len(prefix):])
+	if nil != err {
+		return nil, err
+	}
+	v, err := db.decodeVersion(key, vt.(int64), t.UnixNano(), stored[0])
+	if nil != err {
+		return nil, err
+	}
+	if v.Deleted {
+		return nil, ErrNotFound
+	}
+	return v.Value, nil
+}
+
+// Versions returns the stored versions of the key, oldest first.
+func (db *Database) Versions(key []byte) ([]Version, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	prefix := sysKey("version", key)
+	var versions []Version
+	err := db.scanRaw(nil, prefix, 1000, func(entry, stored []byte) error {
+		t, _, err := decodeKeyPart(entry[len(prefix):])
+		if nil != err {
+			return err
+		}
+		v, err := db.decodeVersion(key, t.(int64), t.(int64), stored)
+		if nil != err {
+			return err
+		}
+		versions = append(versions, v)
+		return nil
+	})
+	return versions, err
+}
@@ -3,15 +3,91 @@ package gophia
 /*
 #cgo LDFLAGS: -lsophia
 #include <sophia.h>
+#include <string.h>
 
 int sp_ctl_dir(void *p, uint32_t access, char *dir) {
 	return sp_ctl(p, SPDIR, access, dir);
 }
 
-int go_sp_comparator(void *a, size_t asz, void *b, size_t bsz, void *arg);
+int go_sp_comparator(char *a, size_t asz, char *b, size_t bsz, uintptr_t h);
 
-int sp_ctl_cmp(void *p, void *cmp) {
-	return sp_ctl(p, SPCMP, &go_sp_comparator, cmp);
+static int gophia_cmp_go(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	return go_sp_comparator(a, asz, b, bsz, (uintptr_t)arg);
+}
+
+int sp_ctl_cmp(void *p, uintptr_t h) {
+	return sp_ctl(p, SPCMP, &gophia_cmp_go, (void*)h);
+}
+
+static int gophia_cmp_bytes(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	size_t n = asz < bsz ? asz : bsz;
+	int c = memcmp(a, b, n);
+	if (0 != c) {
+		return c < 0 ? -1 : 1;
+	}
+	if (asz == bsz) {
+		return 0;
+	}
+	return asz < bsz ? -1 : 1;
+}
+
+static int gophia_cmp_bytes_reverse(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	return gophia_cmp_bytes(b, bsz, a, asz, arg);
+}
+
+// Keys of the wrong length for a numeric ordering are ordered by length,
+// and then bytewise, so that the ordering stays total.
+static int gophia_cmp_length(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	if (asz != bsz) {
+		return asz < bsz ? -1 : 1;
+	}
+	return gophia_cmp_bytes(a, asz, b, bsz, arg);
+}
+
+static int gophia_cmp_uint32(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	uint32_t x, y;
+	if (4 != asz || 4 != bsz) {
+		return gophia_cmp_length(a, asz, b, bsz, arg);
+	}
+	memcpy(&x, a, 4);
+	memcpy(&y, b, 4);
+	return x == y ? 0 : (x < y ? -1 : 1);
+}
+
+static int gophia_cmp_uint64(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	uint64_t x, y;
+	if (8 != asz || 8 != bsz) {
+		return gophia_cmp_length(a, asz, b, bsz, arg);
+	}
+	memcpy(&x, a, 8);
+	memcpy(&y, b, 8);
+	return x == y ? 0 : (x < y ? -1 : 1);
+}
+
+static int gophia_cmp_int64(char *a, size_t asz, char *b, size_t bsz, void *arg) {
+	int64_t x, y;
+	if (8 != asz || 8 != bsz) {
+		return gophia_cmp_length(a, asz, b, bsz, arg);
+	}
+	memcpy(&x, a, 8);
+	memcpy(&y, b, 8);
+	return x == y ? 0 : (x < y ? -1 : 1);
+}
+
+int sp_ctl_cmp_native(void *p, int which) {
+	switch (which) {
+	case 0:
+		return sp_ctl(p, SPCMP, &gophia_cmp_bytes, NULL);
+	case 1:
+		return sp_ctl(p, SPCMP, &gophia_cmp_bytes_reverse, NULL);
+	case 2:
+		return sp_ctl(p, SPCMP, &gophia_cmp_uint32, NULL);
+	case 3:
+		return sp_ctl(p, SPCMP, &gophia_cmp_uint64, NULL);
+	case 4:
+		return sp_ctl(p, SPCMP, &gophia_cmp_int64, NULL);
+	}
+	return -1;
 }
 
 int sp_ctl_page(void *p, uint32_t count) {
@@ -1,8 +1,6 @@
 package gophia
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 )
 
@@ -32,14 +30,14 @@ func (db *Database) Each(order Order, key []byte, each func(key []byte, value []
 	return nil
 }
 
-// GetAO returns on object value for a byte-array key.
+// GetAO returns on object value for a byte-array key. If the object
+// is Versioned, the stored value is migrated to the object's version.
 func (db *Database) GetAO(key []byte, out interface{}) error {
 	buf, err := db.Get(key)
 	if nil != err {
 		return err
 	}
-	dec := gob.NewDecoder(bytes.NewReader(buf))
-	return dec.Decode(out)
+	return decodeObject(buf, out)
 }
 
 // GetS retrieves an array value for a string key. It is a convenience
@@ -157,15 +155,14 @@ func Open(access Access, directory string) (*Database, error) {
 	return db, nil
 }
 
-// SetAO sets a byte array key to an object value.
+// SetAO sets a byte array key to an object value. If the object is
+// Versioned, its schema version is stored with it.
 func (db *Database) SetAO(key []byte, value interface{}) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(value)
+	buf, err := encodeObject(value)
 	if nil != err {
 		return err
 	}
-	return db.Set(key, buf.Bytes())
+	return db.Set(key, buf)
 }
 
 // SetSA sets a string key to a byte array value.
@@ -196,8 +193,7 @@ func (cur *Cursor) ValueO(out interface{}) error {
 	if nil == buf {
 		return errors.New("Value is nil")
 	}
-	dec := gob.NewDecoder(bytes.NewReader(buf))
-	return dec.Decode(out)
+	return decodeObject(buf, out)
 }
 
 // ValueS returns the current value as a string.
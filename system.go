@@ -0,0 +1,39 @@
+package gophia
+
+import (
+	"bytes"
+)
+
+// sysPrefix starts every key that gophia stores for its own use, such as
+// migration checkpoints and index entries. Keys with this prefix are skipped by Cursors,
+// and their values are stored without applying ValueCodecs.
+var sysPrefix = []byte("\xffgophia\x00")
+
+// sysKey returns the system key for the parts, encoded with EncodeKey.
+func sysKey(parts ...interface{}) []byte {
+	key := append([]byte{}, sysPrefix...)
+	for _, p := range parts {
+		var err error
+		key, err = appendKeyPart(key, p)
+		if nil != err {
+			panic(err)
+		}
+	}
+	return key
+}
+
+// bucketPrefix starts every key stored in a Bucket. Keys with this
+// prefix are skipped by Cursors over the whole database, but are
+// otherwise ordinary keys.
+var bucketPrefix = []byte("\xfegophia\x00")
+
+// isHiddenKey returns true if a Cursor over the whole database should
+// skip the key.
+func isHiddenKey(key []byte) bool {
+	return isSysKey(key) || bytes.HasPrefix(key, bucketPrefix)
+}
+
+// isSysKey returns true if the key is a system key.
+func isSysKey(key []byte) bool {
+	return bytes.HasPrefix(key, sysPrefix)
+}